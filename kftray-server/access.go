@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// accessLog receives one line per completed session, apart from the
+// diagnostic log. It is nil when ACCESS_LOG is unset.
+var accessLog *slog.Logger
+
+// setupAccessLog reads ACCESS_LOG (stdout, stderr or a file path appended
+// to) and ACCESS_LOG_FORMAT (json or text, default json).
+func setupAccessLog() error {
+	dest := os.Getenv("ACCESS_LOG")
+	if dest == "" {
+		return nil
+	}
+
+	var out *os.File
+	switch dest {
+	case "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("invalid ACCESS_LOG: %w", err)
+		}
+		out = f
+	}
+
+	// Access lines carry no level; every one is a completed session.
+	options := &slog.HandlerOptions{ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && a.Key == slog.LevelKey {
+			return slog.Attr{}
+		}
+		return a
+	}}
+	var handler slog.Handler
+	switch format := strings.ToLower(os.Getenv("ACCESS_LOG_FORMAT")); format {
+	case "", "json":
+		handler = slog.NewJSONHandler(out, options)
+	case "text":
+		handler = slog.NewTextHandler(out, options)
+	default:
+		return fmt.Errorf("invalid ACCESS_LOG_FORMAT: %s", format)
+	}
+	accessLog = slog.New(handler)
+	return nil
+}
+
+// logAccess writes the access log line for a session that just ended.
+func logAccess(stats *sessionStats) {
+	if accessLog == nil {
+		return
+	}
+	accessLog.LogAttrs(context.Background(), slog.LevelInfo, "session",
+		slog.String("tunnel", stats.tunnel),
+		slog.String("client", stats.client),
+		slog.String("target", stats.target),
+		slog.Time("started", stats.started),
+		slog.Float64("duration_seconds", time.Since(stats.started).Seconds()),
+		slog.Int64("bytes_to_target", stats.toTarget.Load()),
+		slog.Int64("bytes_to_client", stats.toClient.Load()),
+		slog.String("close_reason", stats.closeReason()),
+	)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// readiness tracks which tunnels have bound their listeners, and whether the
+// process has started draining for shutdown.
+type readiness struct {
+	mu       sync.Mutex
+	pending  map[string]chan struct{}
+	draining bool
+}
+
+func newReadiness() *readiness {
+	return &readiness{pending: make(map[string]chan struct{})}
+}
+
+// add registers a tunnel that is not ready until it calls markReady. The
+// returned channel is closed once it does, or once the tunnel is removed.
+func (r *readiness) add(name string) <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ready := make(chan struct{})
+	r.pending[name] = ready
+	return ready
+}
+
+// remove forgets a stopped tunnel.
+func (r *readiness) remove(name string) {
+	r.markReady(name)
+}
+
+func (r *readiness) markReady(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ready, ok := r.pending[name]; ok {
+		close(ready)
+		delete(r.pending, name)
+	}
+}
+
+func (r *readiness) setDraining() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.draining = true
+}
+
+func (r *readiness) isDraining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.draining
+}
+
+func (r *readiness) notReady() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.pending))
+	for name := range r.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// startAdminServer serves the liveness and readiness probes, the Prometheus
+// metrics, which include the Go runtime and process metrics, and the list of
+// active sessions on their own port so they never share a listener with
+// relayed traffic. /loglevel reports the log level and changes it on PUT.
+// With withPprof, the net/http/pprof profiles are served under /debug/pprof/
+// too.
+func (r *relay) startAdminServer(port int, withPprof bool) {
+	router := mux.NewRouter()
+	router.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if r.ready.isDraining() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if pending := r.ready.notReady(); len(pending) > 0 {
+			http.Error(w, "waiting for tunnels: "+strings.Join(pending, ", "), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}).Methods(http.MethodGet)
+	router.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+	router.HandleFunc("/sessions", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]sessionInfo{"sessions": r.sessions.list()})
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/loglevel", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, logLevel.Level().String())
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/loglevel", func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(req.Body, 64))
+		var level slog.Level
+		if err == nil {
+			err = level.UnmarshalText(bytes.TrimSpace(body))
+		}
+		if err != nil {
+			http.Error(w, "expected debug, info, warn or error", http.StatusBadRequest)
+			return
+		}
+		setLogLevel(level)
+		fmt.Fprintln(w, level.String())
+	}).Methods(http.MethodPut)
+	if withPprof {
+		router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	}
+
+	// The listener comes from listenConfig so that, with hot restart, the
+	// admin port is shared with the previous process like the tunnel ports.
+	listener, err := listenConfig.Listen(context.Background(), "tcp", r.listenAddr(port))
+	if err != nil {
+		fatal("Failed to start admin server", "error", err)
+	}
+	server := &http.Server{
+		Handler:           router,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	slog.Info("Admin server listening", "port", port)
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fatal("Admin server failed", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientLimiterTTL is how long an idle client's rate limiter is retained.
+const clientLimiterTTL = 5 * time.Minute
+
+var (
+	errNotAllowed         = errors.New("client address not in ALLOWED_CIDRS")
+	errTooManyConnections = errors.New("connection limit reached")
+	errRateLimited        = errors.New("client connection rate exceeded")
+)
+
+// admissionControl decides whether a new connection may be relayed: the
+// client must be within ALLOWED_CIDRS, MAX_CONNECTIONS applies across all
+// tunnels, and new connections are rate limited per client IP.
+type admissionControl struct {
+	allowed []*net.IPNet
+
+	maxConns int64
+	active   atomic.Int64
+
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// loadAdmissionControl reads ALLOWED_CIDRS (comma-separated), MAX_CONNECTIONS,
+// RATE_LIMIT (new connections per second per client IP) and RATE_LIMIT_BURST.
+// Unset or zero values disable the corresponding check.
+func loadAdmissionControl() (*admissionControl, error) {
+	l := &admissionControl{clients: make(map[string]*clientLimiter)}
+
+	allowed, err := cidrsFromEnv("ALLOWED_CIDRS")
+	if err != nil {
+		return nil, err
+	}
+	l.allowed = allowed
+
+	if value := os.Getenv("MAX_CONNECTIONS"); value != "" {
+		maxConns, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxConns < 0 {
+			return nil, fmt.Errorf("invalid MAX_CONNECTIONS: %s", value)
+		}
+		l.maxConns = maxConns
+	}
+
+	if value := os.Getenv("RATE_LIMIT"); value != "" {
+		perSecond, err := strconv.ParseFloat(value, 64)
+		if err != nil || perSecond < 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT: %s", value)
+		}
+		l.limit = rate.Limit(perSecond)
+		l.burst = int(math.Max(1, math.Ceil(perSecond)))
+	}
+
+	if value := os.Getenv("RATE_LIMIT_BURST"); value != "" {
+		burst, err := strconv.Atoi(value)
+		if err != nil || burst <= 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_BURST: %s", value)
+		}
+		if l.limit == 0 {
+			return nil, errors.New("RATE_LIMIT_BURST requires RATE_LIMIT")
+		}
+		l.burst = burst
+	}
+
+	return l, nil
+}
+
+func (l *admissionControl) enabled() bool {
+	return len(l.allowed) > 0 || l.maxConns > 0 || l.limit > 0
+}
+
+// admit checks a new connection from addr against the admission rules. On
+// success the returned release func must be called once the connection is
+// closed.
+func (l *admissionControl) admit(addr net.Addr) (release func(), err error) {
+	if len(l.allowed) > 0 && !containsIP(l.allowed, clientIP(addr)) {
+		return nil, errNotAllowed
+	}
+
+	if l.limit > 0 && !l.allow(clientIP(addr)) {
+		return nil, errRateLimited
+	}
+
+	if l.maxConns > 0 {
+		if l.active.Add(1) > l.maxConns {
+			l.active.Add(-1)
+			return nil, errTooManyConnections
+		}
+		var once sync.Once
+		return func() { once.Do(func() { l.active.Add(-1) }) }, nil
+	}
+	return func() {}, nil
+}
+
+// cidrsFromEnv reads a comma-separated list of CIDRs from the environment
+// variable name. It returns nil when the variable is unset.
+func cidrsFromEnv(name string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(os.Getenv(name), ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry: %s", name, cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// containsIP reports whether ip is within any of networks.
+func containsIP(networks []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *admissionControl) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > clientLimiterTTL {
+		for key, client := range l.clients {
+			if now.Sub(client.lastSeen) > clientLimiterTTL {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+	return client.limiter.AllowN(now, 1)
+}
+
+func clientIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// rejectionKind maps an admission error to the kind label of the errors
+// metric.
+func rejectionKind(err error) string {
+	if errors.Is(err, errNotAllowed) {
+		return "denied"
+	}
+	return "limit"
+}
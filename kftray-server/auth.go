@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	authNonceSize = 32
+	authTimeout   = 10 * time.Second
+	authOK        = 0x01
+)
+
+var errAuthFailed = errors.New("invalid pre-shared key response")
+
+// transportSecurity holds the protections applied to every accepted TCP
+// connection, and to every broker connection of a reverse tunnel, before any
+// data is relayed.
+type transportSecurity struct {
+	tlsConfig *tls.Config
+	psk       []byte
+
+	// brokerTLS, when set, is used to dial the broker of reverse tunnels.
+	brokerTLS *tls.Config
+}
+
+func (s transportSecurity) enabled() bool {
+	return s.tlsConfig != nil || s.psk != nil
+}
+
+func (s transportSecurity) listen(addr string, trustedProxies []*net.IPNet) (net.Listener, error) {
+	return listenTCP(addr, s.tlsConfig, trustedProxies)
+}
+
+// authenticate completes the TLS handshake, if any, and then the pre-shared
+// key challenge: the server sends a random nonce, the client must answer with
+// HMAC-SHA256(psk, nonce), and the server acknowledges with a single byte.
+// On a reverse tunnel's outbound connection the relay still sends the
+// challenge, so it is the broker that must prove it knows the key.
+func (s transportSecurity) authenticate(conn net.Conn) error {
+	if err := completeHandshake(conn); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	if s.psk == nil {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(authTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, authNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return fmt.Errorf("failed to send nonce: %w", err)
+	}
+
+	response := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return fmt.Errorf("failed to read handshake response: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, s.psk)
+	mac.Write(nonce)
+	if !hmac.Equal(response, mac.Sum(nil)) {
+		return errAuthFailed
+	}
+
+	if _, err := conn.Write([]byte{authOK}); err != nil {
+		return fmt.Errorf("failed to acknowledge handshake: %w", err)
+	}
+	return nil
+}
+
+// loadPSK reads the pre-shared key from AUTH_PSK, or from the file named by
+// AUTH_PSK_FILE so it can be mounted from a Kubernetes secret. It returns nil
+// when no key is configured.
+func loadPSK() ([]byte, error) {
+	psk := os.Getenv("AUTH_PSK")
+	pskFile := os.Getenv("AUTH_PSK_FILE")
+
+	if psk != "" && pskFile != "" {
+		return nil, errors.New("AUTH_PSK and AUTH_PSK_FILE are mutually exclusive")
+	}
+	if pskFile != "" {
+		data, err := os.ReadFile(pskFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read AUTH_PSK_FILE: %w", err)
+		}
+		psk = strings.TrimSpace(string(data))
+		if psk == "" {
+			return nil, fmt.Errorf("AUTH_PSK_FILE %s is empty", pskFile)
+		}
+	}
+	if psk == "" {
+		return nil, nil
+	}
+	return []byte(psk), nil
+}
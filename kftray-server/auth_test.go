@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestPSKHandshake relays through a tunnel that requires AUTH_PSK and checks
+// that only clients answering the challenge with the same key get through.
+func TestPSKHandshake(t *testing.T) {
+	r := newTestRelay(t)
+	r.security.psk = []byte("secret")
+	addr := startEchoTunnel(t, r, "tcp")
+
+	tests := []struct {
+		name     string
+		key      string
+		truncate bool // send half of the response and close the write half
+		wantErr  bool
+	}{
+		{name: "matching key", key: "secret"},
+		{name: "wrong key", key: "guess", wantErr: true},
+		{name: "truncated response", key: "secret", truncate: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			nonce := make([]byte, authNonceSize)
+			if _, err := io.ReadFull(conn, nonce); err != nil {
+				t.Fatalf("read nonce: %v", err)
+			}
+			mac := hmac.New(sha256.New, []byte(tt.key))
+			mac.Write(nonce)
+			response := mac.Sum(nil)
+			if tt.truncate {
+				response = response[:len(response)/2]
+			}
+			if _, err := conn.Write(response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.truncate {
+				conn.(*net.TCPConn).CloseWrite()
+			}
+
+			var ack [1]byte
+			_, err = io.ReadFull(conn, ack[:])
+			if err == nil && ack[0] != authOK {
+				t.Fatalf("acknowledgement = %#x, want %#x", ack[0], authOK)
+			}
+			if err == nil {
+				err = echoOver(conn)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("relay error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
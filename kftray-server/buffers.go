@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultWriteQueueDepth = 64
+
+var errMemoryLimit = errors.New("buffer memory limit reached")
+
+// Buffer pools let the relay loops reuse read and frame buffers instead of
+// allocating them per connection or per packet. Their sizes are fixed by
+// setupBuffers before any tunnel starts.
+var (
+	datagramBuffers = newBufferPool(muxHeaderSize + maxDatagramSize + checksumSize)
+	streamBuffers   = newBufferPool(tcpBufferSize)
+)
+
+// bufferSettings holds the memory knobs read by setupBuffers.
+var bufferSettings = struct {
+	// maxDatagram is the largest datagram relayed, which is also the size
+	// of the buffers datagrams are read into.
+	maxDatagram int
+
+	// writeQueueDepth is how many frames may wait to be written to one
+	// udp or udp-mux connection before its UDP readers block.
+	writeQueueDepth int
+}{maxDatagramSize, defaultWriteQueueDepth}
+
+// bufferMemory accounts for the bytes held by both buffer pools.
+var bufferMemory memoryBudget
+
+// setupBuffers reads UDP_BUFFER_SIZE (the largest datagram relayed, up to
+// 65535 bytes), WRITE_QUEUE_DEPTH (frames queued per udp or udp-mux
+// connection) and BUFFER_MEMORY_LIMIT (bytes, optionally with a Ki, Mi or Gi
+// suffix, that relay buffers may hold before new connections wait and
+// queued datagrams are dropped).
+func setupBuffers() error {
+	if value := os.Getenv("UDP_BUFFER_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 512 || size > maxDatagramSize {
+			return fmt.Errorf("invalid UDP_BUFFER_SIZE: %s", value)
+		}
+		bufferSettings.maxDatagram = size
+		datagramBuffers = newBufferPool(muxHeaderSize + size + checksumSize)
+	}
+
+	if value := os.Getenv("WRITE_QUEUE_DEPTH"); value != "" {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth <= 0 {
+			return fmt.Errorf("invalid WRITE_QUEUE_DEPTH: %s", value)
+		}
+		bufferSettings.writeQueueDepth = depth
+	}
+
+	if value := os.Getenv("BUFFER_MEMORY_LIMIT"); value != "" {
+		limit, err := parseByteSize(value)
+		if err != nil || limit <= 0 {
+			return fmt.Errorf("invalid BUFFER_MEMORY_LIMIT: %s", value)
+		}
+		bufferMemory.setLimit(limit)
+	}
+	return nil
+}
+
+// parseByteSize parses a byte count with an optional Ki, Mi or Gi suffix, as
+// used for Kubernetes memory limits.
+func parseByteSize(value string) (int64, error) {
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"Ki": 1 << 10, "Mi": 1 << 20, "Gi": 1 << 30} {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			value, multiplier = number, m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// bufferPool hands out byte slices of a fixed size. Pointers to slices are
+// pooled so that get and put do not allocate.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{size: size, pool: sync.Pool{New: func() any {
+		buf := make([]byte, size)
+		return &buf
+	}}}
+}
+
+// get returns a buffer for a connection or session that has already been
+// admitted, even when the memory limit has been reached.
+func (p *bufferPool) get() *[]byte {
+	bufferMemory.acquire(p.size)
+	return p.pool.Get().(*[]byte)
+}
+
+// tryGet returns a buffer, or false when the memory limit has been reached.
+func (p *bufferPool) tryGet() (*[]byte, bool) {
+	if !bufferMemory.tryAcquire(p.size) {
+		return nil, false
+	}
+	return p.pool.Get().(*[]byte), true
+}
+
+func (p *bufferPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+	bufferMemory.release(p.size)
+}
+
+// memoryBudget tracks the bytes held in pooled buffers against an optional
+// limit. Buffers of running sessions are never refused, so sessions cannot
+// deadlock waiting on each other; instead new connections wait for memory
+// and queued datagrams that would exceed the limit are dropped.
+type memoryBudget struct {
+	mu    sync.Mutex
+	freed *sync.Cond
+	limit int64
+	used  int64
+}
+
+func (b *memoryBudget) setLimit(limit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+}
+
+func (b *memoryBudget) acquire(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used += int64(n)
+}
+
+func (b *memoryBudget) tryAcquire(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used+int64(n) > b.limit {
+		return false
+	}
+	b.used += int64(n)
+	return true
+}
+
+func (b *memoryBudget) release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= int64(n)
+	if b.freed != nil {
+		b.freed.Broadcast()
+	}
+}
+
+// exhausted reports whether the buffers in use have reached the limit.
+func (b *memoryBudget) exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit > 0 && b.used >= b.limit
+}
+
+// wait blocks while the buffers in use have reached the limit, and returns
+// false without waiting further once stopped reports true. Whatever makes
+// stopped report true must call wake afterwards.
+func (b *memoryBudget) wait(stopped func() bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.freed == nil {
+		b.freed = sync.NewCond(&b.mu)
+	}
+	for b.limit > 0 && b.used >= b.limit {
+		if stopped() {
+			return false
+		}
+		b.freed.Wait()
+	}
+	return true
+}
+
+// wake makes every waiter check again whether it should stop.
+func (b *memoryBudget) wake() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.freed != nil {
+		b.freed.Broadcast()
+	}
+}
+
+// memoryLimitListener holds off accepting connections while the buffer
+// memory limit has been reached, leaving new clients in the listen backlog.
+// Closing it also ends a wait in Accept, so a stopped tunnel can return.
+type memoryLimitListener struct {
+	net.Listener
+	closed atomic.Bool
+}
+
+func (l *memoryLimitListener) Accept() (net.Conn, error) {
+	if !bufferMemory.wait(l.closed.Load) {
+		return nil, net.ErrClosed
+	}
+	return l.Listener.Accept()
+}
+
+func (l *memoryLimitListener) Close() error {
+	l.closed.Store(true)
+	bufferMemory.wake()
+	return l.Listener.Close()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms, used as bits in the mask the server offers and as
+// the single value the client selects.
+const (
+	compressionNone   byte = 0
+	compressionSnappy byte = 1 << 0
+	compressionZstd   byte = 1 << 1
+)
+
+// loadCompression reads the comma-separated COMPRESSION list (zstd, snappy)
+// of algorithms clients may choose. It returns compressionNone when unset.
+func loadCompression() (byte, error) {
+	var mask byte
+	for _, name := range strings.Split(os.Getenv("COMPRESSION"), ",") {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "":
+		case "snappy":
+			mask |= compressionSnappy
+		case "zstd":
+			mask |= compressionZstd
+		default:
+			return 0, fmt.Errorf("invalid COMPRESSION: %s", name)
+		}
+	}
+	return mask, nil
+}
+
+// negotiateCompression offers the offered algorithms to the client as a
+// one-byte mask and reads back its one-byte choice, which is either zero or
+// one of the offered bits. The returned conn compresses the relayed stream
+// accordingly. Nothing is exchanged when no algorithm is offered.
+func negotiateCompression(conn net.Conn, offered byte) (net.Conn, error) {
+	if offered == compressionNone {
+		return conn, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(authTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write([]byte{offered}); err != nil {
+		return nil, fmt.Errorf("failed to offer compression: %w", err)
+	}
+	var choice [1]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return nil, fmt.Errorf("failed to read compression choice: %w", err)
+	}
+
+	switch choice[0] {
+	case compressionNone:
+		return conn, nil
+	case compressionSnappy:
+		if offered&compressionSnappy == 0 {
+			break
+		}
+		return newCompressedConn(conn, snappy.NewReader(conn), snappy.NewWriter(conn), nil), nil
+	case compressionZstd:
+		if offered&compressionZstd == 0 {
+			break
+		}
+		decoder, err := zstd.NewReader(conn, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		encoder, err := zstd.NewWriter(conn, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			decoder.Close()
+			return nil, err
+		}
+		return newCompressedConn(conn, decoder, encoder, decoder.Close), nil
+	}
+	return nil, fmt.Errorf("client chose unsupported compression %#x", choice[0])
+}
+
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressedConn decompresses reads from and compresses writes to the
+// underlying connection, flushing after every write so interactive
+// protocols are not delayed.
+type compressedConn struct {
+	net.Conn
+	reader      io.Reader
+	writer      flushWriter
+	closeReader func()
+	writerOnce  sync.Once
+	closeOnce   sync.Once
+
+	// readMu and writeMu are held for each read and write, so Close
+	// releases the codecs only once an operation in progress has returned.
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+}
+
+func newCompressedConn(conn net.Conn, reader io.Reader, writer flushWriter, closeReader func()) *compressedConn {
+	return &compressedConn{Conn: conn, reader: reader, writer: writer, closeReader: closeReader}
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	return c.reader.Read(p)
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.writer.Flush()
+}
+
+// CloseWrite ends the compressed stream and then half-closes the underlying
+// connection.
+func (c *compressedConn) CloseWrite() error {
+	return errors.Join(c.closeWriter(), closeWrite(c.Conn))
+}
+
+func (c *compressedConn) closeWriter() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	var err error
+	c.writerOnce.Do(func() {
+		err = c.writer.Close()
+	})
+	return err
+}
+
+func (c *compressedConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		// Closing the connection first unblocks a pending read or write,
+		// which would otherwise race with releasing the codecs. The end of
+		// the compressed stream is only written by CloseWrite.
+		err = c.Conn.Close()
+		c.closeWriter()
+		if c.closeReader != nil {
+			c.readMu.Lock()
+			c.closeReader()
+			c.readMu.Unlock()
+		}
+	})
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// dialCompressed connects to a tunnel offering compression and selects
+// choice.
+func dialCompressed(t *testing.T, addr string, choice byte) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var offered [1]byte
+	if _, err := io.ReadFull(conn, offered[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte{choice}); err != nil {
+		t.Fatal(err)
+	}
+	switch choice {
+	case compressionNone:
+		return conn
+	case compressionSnappy:
+		return newCompressedConn(conn, snappy.NewReader(conn), snappy.NewWriter(conn), nil)
+	}
+	decoder, err := zstd.NewReader(conn, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder, err := zstd.NewWriter(conn, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newCompressedConn(conn, decoder, encoder, decoder.Close)
+}
+
+// TestCompressionRoundTrip relays a payload larger than the codecs' blocks
+// through a tunnel offering compression, with each choice a client can make.
+func TestCompressionRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("kftray compression round trip "), 64*1024)
+
+	tests := []struct {
+		name    string
+		offered byte
+		choice  byte
+		wantErr bool
+	}{
+		{name: "snappy", offered: compressionSnappy | compressionZstd, choice: compressionSnappy},
+		{name: "zstd", offered: compressionSnappy | compressionZstd, choice: compressionZstd},
+		{name: "none", offered: compressionSnappy | compressionZstd, choice: compressionNone},
+		{name: "not offered", offered: compressionSnappy, choice: compressionZstd, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRelay(t)
+			r.compression = tt.offered
+			conn := dialCompressed(t, startEchoTunnel(t, r, "tcp"), tt.choice)
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// The echo is read while the payload is written, so neither side
+			// blocks on a full socket buffer.
+			written := make(chan error, 1)
+			go func() {
+				_, err := conn.Write(payload)
+				written <- err
+			}()
+			got := make([]byte, len(payload))
+			_, err := io.ReadFull(conn, got)
+			if err == nil && !bytes.Equal(got, payload) {
+				t.Fatal("echoed payload differs from the one sent")
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("relay error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				conn.Close()
+			}
+			<-written
+		})
+	}
+}
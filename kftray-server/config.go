@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultShutdownTimeout = 25 * time.Second
+
+// tunnelConfig describes a single listener and the target it relays to.
+type tunnelConfig struct {
+	Name          string `json:"name" yaml:"name"`
+	LocalPort     int    `json:"local_port" yaml:"local_port"`
+	RemoteAddress string `json:"remote_address" yaml:"remote_address"`
+	RemotePort    int    `json:"remote_port" yaml:"remote_port"`
+	ProxyType     string `json:"proxy_type" yaml:"proxy_type"`
+
+	// ConnectAddress is the broker a reverse tunnel dials out to.
+	ConnectAddress string `json:"connect_address,omitempty" yaml:"connect_address,omitempty"`
+}
+
+type fileConfig struct {
+	Tunnels []tunnelConfig `json:"tunnels" yaml:"tunnels"`
+}
+
+// loadTunnels returns the tunnels declared in the config file, or the single
+// tunnel described by the command-line flags and environment variables when
+// no config file is set.
+func loadTunnels() ([]tunnelConfig, error) {
+	var tunnels []tunnelConfig
+	if path := setting(configFlag, "CONFIG_FILE"); path != "" {
+		if tunnelFlagsSet() {
+			return nil, errors.New("tunnel flags cannot be combined with a config file")
+		}
+		slog.Info("Loading tunnels", "path", path)
+		cfg, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		tunnels = cfg.Tunnels
+	} else {
+		tunnel, err := loadTunnelFromSettings()
+		if err != nil {
+			return nil, err
+		}
+		tunnels = []tunnelConfig{tunnel}
+	}
+
+	if len(tunnels) == 0 {
+		return nil, errors.New("no tunnels configured")
+	}
+
+	// Every tunnel is checked so all of their problems are reported at once.
+	var errs []error
+	names := make(map[string]bool)
+	ports := make(map[int]string)
+	for i := range tunnels {
+		t := &tunnels[i]
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("%s-%d", t.ProxyType, t.LocalPort)
+			if t.ProxyType == "reverse" {
+				t.Name = fmt.Sprintf("%s-%s", t.ProxyType, t.ConnectAddress)
+			}
+		}
+		if names[t.Name] {
+			errs = append(errs, fmt.Errorf("tunnel %q: name is used by more than one tunnel", t.Name))
+		}
+		names[t.Name] = true
+		if err := t.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel %q: %w", t.Name, err))
+		}
+		if t.LocalPort == 0 {
+			continue
+		}
+		if other, ok := ports[t.LocalPort]; ok {
+			errs = append(errs, fmt.Errorf("tunnel %q: local_port %d is already used by tunnel %q", t.Name, t.LocalPort, other))
+		}
+		ports[t.LocalPort] = t.Name
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return tunnels, nil
+}
+
+// loadAdminPort returns the port for the health endpoints from ADMIN_PORT, or
+// 0 when the admin server is disabled.
+func loadAdminPort(tunnels []tunnelConfig) (int, error) {
+	portStr := os.Getenv("ADMIN_PORT")
+	if portStr == "" {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid ADMIN_PORT: %s", portStr)
+	}
+	for _, tunnel := range tunnels {
+		if tunnel.LocalPort == port {
+			return 0, fmt.Errorf("ADMIN_PORT %d is already used by tunnel %q", port, tunnel.Name)
+		}
+	}
+	return port, nil
+}
+
+// loadAdminPprof reports whether ADMIN_PPROF enables the profiling
+// endpoints, which are served by the admin server and so need ADMIN_PORT.
+func loadAdminPprof(adminPort int) (bool, error) {
+	enabled := os.Getenv("ADMIN_PPROF") == "true"
+	if enabled && adminPort == 0 && os.Getenv("ADMIN_PORT") == "" {
+		return false, errors.New("ADMIN_PPROF requires ADMIN_PORT")
+	}
+	return enabled, nil
+}
+
+// loadListenHost returns the IP address from LISTEN_ADDRESS that every
+// listener binds to, such as "::" or "0.0.0.0". It returns "" when unset,
+// which listens on all interfaces, dual-stack where supported.
+func loadListenHost() (string, error) {
+	value := os.Getenv("LISTEN_ADDRESS")
+	if value == "" {
+		return "", nil
+	}
+	host := unbracket(value)
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid LISTEN_ADDRESS: %s", value)
+	}
+	return host, nil
+}
+
+// durationFromEnv parses the Go duration (e.g. "30s") in the named variable,
+// returning fallback when it is unset.
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, value)
+	}
+	return d, nil
+}
+
+func loadTunnelFromSettings() (tunnelConfig, error) {
+	targetHost := setting(remoteAddressFlag, "REMOTE_ADDRESS")
+	targetPortStr := setting(remotePortFlag, "REMOTE_PORT")
+	proxyPortStr := setting(localPortFlag, "LOCAL_PORT")
+	proxyType := setting(proxyTypeFlag, "PROXY_TYPE")
+	connectAddress := setting(connectAddressFlag, "CONNECT_ADDRESS")
+
+	if proxyType == "" {
+		proxyType = "tcp"
+	}
+	if proxyPortStr == "" && proxyType != "reverse" {
+		proxyPortStr = targetPortStr
+	}
+
+	slog.Info("Loaded tunnel configuration",
+		"remote_address", targetHost,
+		"remote_port", targetPortStr,
+		"local_port", proxyPortStr,
+		"proxy_type", proxyType,
+		"connect_address", connectAddress,
+	)
+
+	var targetPort int
+	if targetPortStr != "" {
+		var err error
+		targetPort, err = strconv.Atoi(targetPortStr)
+		if err != nil {
+			return tunnelConfig{}, fmt.Errorf("invalid remote port: %q", targetPortStr)
+		}
+	}
+
+	var proxyPort int
+	if proxyPortStr != "" || proxyType != "reverse" {
+		var err error
+		proxyPort, err = strconv.Atoi(proxyPortStr)
+		if err != nil {
+			return tunnelConfig{}, fmt.Errorf("invalid local port: %q", proxyPortStr)
+		}
+	}
+
+	return tunnelConfig{
+		LocalPort:      proxyPort,
+		RemoteAddress:  targetHost,
+		RemotePort:     targetPort,
+		ProxyType:      proxyType,
+		ConnectAddress: connectAddress,
+	}, nil
+}
+
+// loadConfigFile parses a JSON (.json) or YAML config file.
+func loadConfigFile(path string) (fileConfig, error) {
+	var cfg fileConfig
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if filepath.Ext(path) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&cfg)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&cfg)
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (t tunnelConfig) validate() error {
+	switch t.ProxyType {
+	case "tcp", "udp", "udp-mux", "udp-native", "ws", "quic", "socks5", "http-connect", "reverse":
+	default:
+		return fmt.Errorf("unsupported proxy_type: %s", t.ProxyType)
+	}
+	if t.ProxyType == "reverse" {
+		if t.LocalPort != 0 {
+			return errors.New("local_port is not used by reverse tunnels")
+		}
+		if _, _, err := net.SplitHostPort(t.ConnectAddress); err != nil {
+			return fmt.Errorf("invalid connect_address: %q", t.ConnectAddress)
+		}
+	} else {
+		if t.ConnectAddress != "" {
+			return errors.New("connect_address is only used by reverse tunnels")
+		}
+		if t.LocalPort <= 0 || t.LocalPort > 65535 {
+			return fmt.Errorf("invalid local_port: %d", t.LocalPort)
+		}
+	}
+	if t.dynamicTarget() {
+		return nil
+	}
+	if t.RemotePort < 0 || t.RemotePort > 65535 {
+		return fmt.Errorf("invalid remote_port: %d", t.RemotePort)
+	}
+	return validateTargets(t.RemoteAddress, t.RemotePort)
+}
+
+// unbracket strips the brackets from an IPv6 literal such as "[::1]", which
+// net.JoinHostPort adds itself.
+func unbracket(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// dynamicTarget reports whether clients choose the destination of each
+// connection, in which case remote_address and remote_port are not used.
+func (t tunnelConfig) dynamicTarget() bool {
+	return t.ProxyType == "socks5" || t.ProxyType == "http-connect"
+}
+
+// datagramTarget reports whether the tunnel relays to a UDP target.
+func (t tunnelConfig) datagramTarget() bool {
+	return t.ProxyType == "udp" || t.ProxyType == "udp-mux" || t.ProxyType == "udp-native"
+}
+
+// targetDescription is the target shown in logs.
+func (t tunnelConfig) targetDescription() string {
+	if t.dynamicTarget() {
+		return "client-selected"
+	}
+	specs := splitTargets(t.RemoteAddress)
+	for i, spec := range specs {
+		if _, _, err := net.SplitHostPort(spec); err != nil && !strings.HasPrefix(spec, srvPrefix) {
+			specs[i] = net.JoinHostPort(unbracket(spec), strconv.Itoa(t.RemotePort))
+		}
+	}
+	return strings.Join(specs, ",")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestLoadListenHost(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: ""},
+		{value: "0.0.0.0", want: "0.0.0.0"},
+		{value: "::", want: "::"},
+		{value: "[::]", want: "::"},
+		{value: "[::1]", want: "::1"},
+		{value: "localhost", wantErr: true},
+		{value: "[::", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("LISTEN_ADDRESS", tt.value)
+			got, err := loadListenHost()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadListenHost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("loadListenHost() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBracketedIPv6Target(t *testing.T) {
+	tunnel := tunnelConfig{Name: "v6", LocalPort: 8000, RemoteAddress: "[::1]", RemotePort: 8080, ProxyType: "tcp"}
+	if err := tunnel.validate(); err != nil {
+		t.Fatalf("validate() = %v", err)
+	}
+	if got, want := tunnel.targetDescription(), "[::1]:8080"; got != want {
+		t.Errorf("targetDescription() = %q, want %q", got, want)
+	}
+
+	pool := newTargetPool(tunnel, 0, slog.Default())
+	target, err := pool.pick()
+	if err != nil {
+		t.Fatalf("pick() = %v", err)
+	}
+	if got, want := target.addr, "[::1]:8080"; got != want {
+		t.Errorf("target address = %q, want %q", got, want)
+	}
+}
+
+// TestDualStackListen serves a tcp tunnel with LISTEN_ADDRESS unset and set
+// to [::], and checks that both accept clients over IPv4 and IPv6 loopback.
+func TestDualStackListen(t *testing.T) {
+	requireIPv6(t)
+	echo := startEcho(t, "tcp6", "[::1]:0")
+
+	for _, listenAddress := range []string{"", "[::]"} {
+		t.Run("LISTEN_ADDRESS="+listenAddress, func(t *testing.T) {
+			t.Setenv("LISTEN_ADDRESS", listenAddress)
+			listenHost, err := loadListenHost()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := newTestRelay(t)
+			r.listenHost = listenHost
+
+			port, err := freePort()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tunnel := tunnelConfig{
+				Name:          "dual-stack",
+				LocalPort:     port,
+				RemoteAddress: "[::1]",
+				RemotePort:    echo.Addr().(*net.TCPAddr).Port,
+				ProxyType:     "tcp",
+			}
+			runTestTunnel(t, r, tunnel)
+
+			for _, host := range []string{"127.0.0.1", "::1"} {
+				addr := net.JoinHostPort(host, strconv.Itoa(port))
+				if err := echoRoundTrip(addr); err != nil {
+					t.Errorf("relay via %s: %v", addr, err)
+				}
+			}
+		})
+	}
+}
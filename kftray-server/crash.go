@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// crashDir is where crash dumps are written, or "" to only log them.
+var crashDir string
+
+// setupCrashDumps reads CRASH_DIR, an existing directory that receives a
+// dump for every recovered panic.
+func setupCrashDumps() error {
+	dir := os.Getenv("CRASH_DIR")
+	if dir == "" {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return fmt.Errorf("invalid CRASH_DIR: %s is not a directory", dir)
+	}
+	crashDir = dir
+	return nil
+}
+
+// recoverPanic, deferred at the top of a session goroutine, stops a panic
+// in that session from taking down every other tunnel. The panic is logged
+// with its stack, counted as a "panic" error when metrics is non-nil and,
+// with CRASH_DIR set, written to a crash dump.
+func recoverPanic(logger *slog.Logger, metrics *tunnelMetrics) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	stack := debug.Stack()
+	if metrics != nil {
+		metrics.error("panic")
+	}
+	logger.Error("Recovered from panic", "panic", fmt.Sprint(value), "stack", string(stack))
+
+	if crashDir == "" {
+		return
+	}
+	now := time.Now()
+	path := filepath.Join(crashDir, fmt.Sprintf("kftray-server-crash-%d.txt", now.UnixNano()))
+	dump := fmt.Sprintf("time: %s\ngo: %s\nplatform: %s/%s\npanic: %v\n\n%s",
+		now.UTC().Format(time.RFC3339Nano), runtime.Version(), runtime.GOOS, runtime.GOARCH, value, stack)
+	if err := os.WriteFile(path, []byte(dump), 0o600); err != nil {
+		logger.Warn("Failed to write crash dump", "path", path, "error", err)
+		return
+	}
+	logger.Error("Wrote crash dump", "path", path)
+}
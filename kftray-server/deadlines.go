@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	defaultDialTimeout  = 10 * time.Second
+	defaultWriteTimeout = 30 * time.Second
+)
+
+// timeoutSettings holds the deadlines read by setupTimeouts.
+var timeoutSettings = struct {
+	// dial bounds connecting to targets and brokers.
+	dial time.Duration
+
+	// idle closes a relayed stream connection that carried no traffic in
+	// either direction for this long. Zero keeps idle connections open.
+	idle time.Duration
+
+	// write bounds every write to a client or target, so a peer that stops
+	// reading cannot block the relay. Zero disables the deadline.
+	write time.Duration
+}{defaultDialTimeout, 0, defaultWriteTimeout}
+
+// setupTimeouts reads DIAL_TIMEOUT, IDLE_TIMEOUT and WRITE_TIMEOUT, each a Go
+// duration where 0 disables the idle and write deadlines. Spliced sessions
+// report their traffic too coarsely for either to be enforced, so with
+// ZERO_COPY the write deadline defaults to off and setting either one is
+// rejected. It must run after setupSocketOptions.
+func setupTimeouts() error {
+	dial, err := durationFromEnv("DIAL_TIMEOUT", defaultDialTimeout)
+	if err != nil {
+		return err
+	}
+	idle, err := durationFromEnv("IDLE_TIMEOUT", 0)
+	if err != nil {
+		return err
+	}
+	writeDefault := defaultWriteTimeout
+	if socketSettings.zeroCopy {
+		writeDefault = 0
+	}
+	write, err := durationFromEnv("WRITE_TIMEOUT", writeDefault)
+	if err != nil {
+		return err
+	}
+	if socketSettings.zeroCopy && (idle > 0 || write > 0) {
+		return errors.New("IDLE_TIMEOUT and WRITE_TIMEOUT cannot be enforced on sessions spliced with ZERO_COPY; unset them or disable ZERO_COPY")
+	}
+	timeoutSettings.dial = dial
+	timeoutSettings.idle = idle
+	timeoutSettings.write = write
+	return nil
+}
+
+// deadlineConn arms the write deadline before every write and records
+// traffic on the session's activity. Idleness is enforced by watchIdle
+// rather than read deadlines, because a read that fails on a timeout leaves
+// WebSocket and compressed streams unusable.
+type deadlineConn struct {
+	net.Conn
+	session *activity
+}
+
+// withDeadlines wraps the two legs of a session in deadlineConns sharing one
+// activity, which it returns for watchIdle.
+func withDeadlines(conn, upstream net.Conn) (net.Conn, net.Conn, *activity) {
+	session := new(activity)
+	session.touch()
+	return &deadlineConn{conn, session}, &deadlineConn{upstream, session}, session
+}
+
+// watchIdle calls expire once the session has carried no traffic in either
+// direction for the idle timeout. The returned function stops the watch. A
+// zero timeout watches nothing.
+func watchIdle(session *activity, expire func()) (stop func()) {
+	timeout := timeoutSettings.idle
+	if timeout <= 0 {
+		return func() {}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-timer.C:
+			}
+			idle := session.idle()
+			if idle >= timeout {
+				expire()
+				return
+			}
+			timer.Reset(timeout - idle)
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.session.touch()
+	}
+	return n, err
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	setWriteDeadline(c.Conn)
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.session.touch()
+	}
+	return n, err
+}
+
+func (c *deadlineConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// setWriteDeadline bounds the next write to conn by the write timeout.
+func setWriteDeadline(conn net.Conn) {
+	if timeoutSettings.write > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeoutSettings.write))
+	}
+}
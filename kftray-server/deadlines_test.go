@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// setIdleTimeout overrides IDLE_TIMEOUT for the rest of the test.
+func setIdleTimeout(t *testing.T, idle time.Duration) {
+	t.Helper()
+	saved := timeoutSettings
+	t.Cleanup(func() { timeoutSettings = saved })
+	timeoutSettings.idle = idle
+}
+
+// startTicker serves a TCP target that writes chunks of size bytes at
+// interval, then reads a reply of replySize bytes and falls silent, and
+// reports the reply, or nil when the connection ends before it arrives.
+func startTicker(t *testing.T, chunks, size, replySize int, interval time.Duration) (net.Listener, <-chan []byte) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	replies := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				chunk := make([]byte, size)
+				for i := 0; i < chunks; i++ {
+					time.Sleep(interval)
+					if _, err := conn.Write(chunk); err != nil {
+						replies <- nil
+						return
+					}
+				}
+				reply := make([]byte, replySize)
+				if _, err := io.ReadFull(conn, reply); err != nil {
+					reply = nil
+				}
+				replies <- reply
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return listener, replies
+}
+
+// TestIdleTimeout relays a session where only the target sends, at
+// intervals shorter than the idle timeout, then has the client reply, and
+// checks that the session stays open while either side is active and is
+// closed once both fall silent. Nothing arrives from the client for longer
+// than the idle timeout, which must not break WebSocket or compressed
+// streams.
+func TestIdleTimeout(t *testing.T) {
+	const idle = 300 * time.Millisecond
+	setIdleTimeout(t, idle)
+
+	tests := []struct {
+		name        string
+		proxyType   string
+		compression byte
+		dial        func(t *testing.T, addr string) net.Conn
+	}{
+		{
+			name:      "tcp",
+			proxyType: "tcp",
+			dial: func(t *testing.T, addr string) net.Conn {
+				conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { conn.Close() })
+				return conn
+			},
+		},
+		{
+			name:        "snappy",
+			proxyType:   "tcp",
+			compression: compressionSnappy,
+			dial: func(t *testing.T, addr string) net.Conn {
+				return dialCompressed(t, addr, compressionSnappy)
+			},
+		},
+		{
+			name:        "zstd",
+			proxyType:   "tcp",
+			compression: compressionZstd,
+			dial: func(t *testing.T, addr string) net.Conn {
+				return dialCompressed(t, addr, compressionZstd)
+			},
+		},
+		{
+			name:      "ws",
+			proxyType: "ws",
+			dial: func(t *testing.T, addr string) net.Conn {
+				ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { ws.Close() })
+				return &wsConn{Conn: ws}
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			const chunks, size = 8, 1024
+			reply := []byte("reply")
+			target, replies := startTicker(t, chunks, size, len(reply), idle/3)
+			r := newTestRelay(t)
+			r.compression = tt.compression
+			port, err := freePort()
+			if err != nil {
+				t.Fatal(err)
+			}
+			runTestTunnel(t, r, tunnelConfig{
+				Name:          "idle-" + tt.name,
+				LocalPort:     port,
+				RemoteAddress: "127.0.0.1",
+				RemotePort:    target.Addr().(*net.TCPAddr).Port,
+				ProxyType:     tt.proxyType,
+			})
+			conn := tt.dial(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, chunks*size)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatalf("read relayed data: %v", err)
+			}
+			if _, err := conn.Write(reply); err != nil {
+				t.Fatal(err)
+			}
+			lastWrite := time.Now()
+			select {
+			case got := <-replies:
+				if !bytes.Equal(got, reply) {
+					t.Fatalf("target received reply %q, want %q", got, reply)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("target did not receive the reply")
+			}
+
+			_, err = conn.Read(buf)
+			if err == nil || isTimeout(err) {
+				t.Fatalf("read = %v, want the relay to close the idle session", err)
+			}
+			if elapsed := time.Since(lastWrite); elapsed < idle/2 {
+				t.Errorf("session closed %v after the last data, want about %v", elapsed, idle)
+			}
+			if !r.sessions.wait(5 * time.Second) {
+				t.Error("session still running after it was closed")
+			}
+		})
+	}
+}
+
+func TestSetupTimeoutsZeroCopy(t *testing.T) {
+	tests := []struct {
+		zeroCopy, idle, write string
+		wantWrite             time.Duration
+		wantErr               bool
+	}{
+		{wantWrite: defaultWriteTimeout},
+		{idle: "1m", write: "5s", wantWrite: 5 * time.Second},
+		{zeroCopy: "true"},
+		{zeroCopy: "true", write: "0"},
+		{zeroCopy: "true", idle: "1m", wantErr: true},
+		{zeroCopy: "true", write: "5s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("ZERO_COPY=%s,IDLE_TIMEOUT=%s,WRITE_TIMEOUT=%s", tt.zeroCopy, tt.idle, tt.write), func(t *testing.T) {
+			savedSockets, savedTimeouts := socketSettings, timeoutSettings
+			t.Cleanup(func() {
+				socketSettings, timeoutSettings = savedSockets, savedTimeouts
+			})
+			t.Setenv("ZERO_COPY", tt.zeroCopy)
+			t.Setenv("IDLE_TIMEOUT", tt.idle)
+			t.Setenv("WRITE_TIMEOUT", tt.write)
+			if err := setupSocketOptions(); err != nil {
+				t.Fatal(err)
+			}
+			err := setupTimeouts()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setupTimeouts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && timeoutSettings.write != tt.wantWrite {
+				t.Errorf("write timeout = %v, want %v", timeoutSettings.write, tt.wantWrite)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+var (
+	configFlag         = flag.String("config", "", "path to a JSON/YAML tunnel config file (env CONFIG_FILE)")
+	localPortFlag      = flag.String("local-port", "", "port to listen on (env LOCAL_PORT, default: the remote port)")
+	remoteAddressFlag  = flag.String("remote-address", "", "target host to relay to, or a comma-separated list of hosts and srv: names to balance over (env REMOTE_ADDRESS)")
+	remotePortFlag     = flag.String("remote-port", "", "target port to relay to (env REMOTE_PORT)")
+	proxyTypeFlag      = flag.String("proxy-type", "", "tcp, udp, udp-mux, udp-native, ws, quic, socks5, http-connect or reverse (env PROXY_TYPE, default: tcp)")
+	connectAddressFlag = flag.String("connect-address", "", "broker host:port a reverse tunnel dials out to (env CONNECT_ADDRESS)")
+	selfTestFlag       = flag.Bool("self-test", false, "relay TCP and UDP-over-TCP traffic to loopback echo targets and exit, non-zero on failure")
+)
+
+func init() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags]\n", os.Args[0])
+		fmt.Fprintf(out, "       %s manifest [flags]\n\n", os.Args[0])
+		fmt.Fprintf(out, "Relays TCP or UDP traffic from a local port to a remote target.\n")
+		fmt.Fprintf(out, "Flags take precedence over the environment variables named below.\n\n")
+		flag.PrintDefaults()
+	}
+}
+
+// setting returns the flag value when it was given on the command line, and
+// the named environment variable otherwise.
+func setting(flagValue *string, env string) string {
+	if *flagValue != "" {
+		return *flagValue
+	}
+	return os.Getenv(env)
+}
+
+// tunnelFlagsSet reports whether any single-tunnel flag was given.
+func tunnelFlagsSet() bool {
+	for _, value := range []*string{localPortFlag, remoteAddressFlag, remotePortFlag, proxyTypeFlag, connectAddressFlag} {
+		if *value != "" {
+			return true
+		}
+	}
+	return false
+}
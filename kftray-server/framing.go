@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// heartbeatLength in a frame's length field marks a heartbeat control
+	// frame, which carries no payload. It can never be a valid datagram
+	// length, so data frames are unaffected.
+	heartbeatLength = math.MaxUint32
+
+	// heartbeatMisses is how many heartbeat intervals may pass without any
+	// frame from the client before the connection is considered dead.
+	heartbeatMisses = 3
+
+	// checksumSize is the CRC-32C trailer that follows the payload of every
+	// data frame when FRAME_CHECKSUM is enabled.
+	checksumSize = 4
+)
+
+var (
+	errFrameTooLarge = errors.New("frame exceeds maximum frame size")
+	errBadChecksum   = errors.New("frame checksum mismatch")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// frameSettings holds the framing options read by setupFraming. They apply
+// to the udp and udp-mux tunnels in both directions.
+var frameSettings = struct {
+	// maxLength is the largest payload length a client frame may announce;
+	// longer frames end the connection before anything is read.
+	maxLength int
+
+	// checksum appends a CRC-32C of the payload to every data frame and
+	// verifies it on frames read from clients.
+	checksum bool
+}{maxDatagramSize, false}
+
+// setupFraming reads MAX_FRAME_SIZE (bytes, at most UDP_BUFFER_SIZE, which is
+// also the default) and FRAME_CHECKSUM (true to checksum frames). It must run
+// after setupBuffers.
+func setupFraming() error {
+	frameSettings.maxLength = bufferSettings.maxDatagram
+	if value := os.Getenv("MAX_FRAME_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 || size > bufferSettings.maxDatagram {
+			return fmt.Errorf("invalid MAX_FRAME_SIZE: %s (must be between 1 and UDP_BUFFER_SIZE %d)", value, bufferSettings.maxDatagram)
+		}
+		frameSettings.maxLength = size
+	}
+	frameSettings.checksum = os.Getenv("FRAME_CHECKSUM") == "true"
+	return nil
+}
+
+// frameWriter queues length-prefixed frames for a udp or udp-mux tunnel
+// and writes them from one goroutine, so concurrent writers never interleave
+// frames. udp-mux frames also carry the peer ID. Writers block while the
+// queue is full, and the first write error is returned to every later
+// writer.
+type frameWriter struct {
+	conn   net.Conn
+	peerID bool
+	queue  chan queuedFrame
+	done   <-chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// queuedFrame is a frame waiting to be written. buf, when set, is the
+// pooled buffer holding it.
+type queuedFrame struct {
+	data []byte
+	buf  *[]byte
+}
+
+// newFrameWriter starts writing frames to conn until done is closed.
+func newFrameWriter(conn net.Conn, peerID bool, done <-chan struct{}, logger *slog.Logger, metrics *tunnelMetrics) *frameWriter {
+	w := &frameWriter{
+		conn:   conn,
+		peerID: peerID,
+		queue:  make(chan queuedFrame, bufferSettings.writeQueueDepth),
+		done:   done,
+	}
+	go w.run(logger, metrics)
+	return w
+}
+
+func (w *frameWriter) run(logger *slog.Logger, metrics *tunnelMetrics) {
+	defer recoverPanic(logger, metrics)
+	// Closing the connection ends the session if the writer stops early,
+	// since its frames could no longer be written.
+	defer w.conn.Close()
+	for {
+		select {
+		case <-w.done:
+			w.drain()
+			return
+		case frame := <-w.queue:
+			if w.failed() == nil {
+				setWriteDeadline(w.conn)
+				if _, err := w.conn.Write(frame.data); err != nil {
+					w.mu.Lock()
+					w.err = err
+					w.mu.Unlock()
+				}
+			}
+			if frame.buf != nil {
+				datagramBuffers.put(frame.buf)
+			}
+		}
+	}
+}
+
+// drain returns the buffers of frames still queued when the connection
+// closes, so they stop counting against the buffer memory limit.
+func (w *frameWriter) drain() {
+	for {
+		select {
+		case frame := <-w.queue:
+			if frame.buf != nil {
+				datagramBuffers.put(frame.buf)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (w *frameWriter) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *frameWriter) headerSize() int {
+	if w.peerID {
+		return muxHeaderSize
+	}
+	return 4
+}
+
+// writeFrame queues payload, which must not exceed the maximum datagram
+// size, as one frame assembled in a pooled buffer. It returns errMemoryLimit,
+// dropping the payload, when no buffer is available under the memory limit.
+func (w *frameWriter) writeFrame(id uint32, payload []byte) error {
+	if err := w.failed(); err != nil {
+		return err
+	}
+	buf, ok := datagramBuffers.tryGet()
+	if !ok {
+		return errMemoryLimit
+	}
+
+	size := w.headerSize()
+	frame := (*buf)[:size+len(payload)]
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	if w.peerID {
+		binary.BigEndian.PutUint32(frame[4:8], id)
+	}
+	copy(frame[size:], payload)
+	if frameSettings.checksum {
+		frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum(payload, crcTable))
+	}
+	return w.enqueue(queuedFrame{data: frame, buf: buf})
+}
+
+func (w *frameWriter) writeHeartbeat() error {
+	if err := w.failed(); err != nil {
+		return err
+	}
+	frame := make([]byte, w.headerSize())
+	binary.BigEndian.PutUint32(frame[0:4], heartbeatLength)
+	return w.enqueue(queuedFrame{data: frame})
+}
+
+func (w *frameWriter) enqueue(frame queuedFrame) error {
+	select {
+	case w.queue <- frame:
+		return nil
+	case <-w.done:
+		if frame.buf != nil {
+			datagramBuffers.put(frame.buf)
+		}
+		return net.ErrClosed
+	}
+}
+
+// readHeader reads the next frame header, skipping heartbeats. With
+// heartbeats enabled, every read must complete within heartbeatMisses
+// intervals, so a silently dead connection fails with a timeout.
+func (r *relay) readHeader(conn net.Conn, header []byte) error {
+	for {
+		if r.heartbeatInterval > 0 {
+			conn.SetReadDeadline(time.Now().Add(heartbeatMisses * r.heartbeatInterval))
+		}
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(header[0:4]) != heartbeatLength {
+			return nil
+		}
+	}
+}
+
+// readPayload reads into buf the payload of a frame whose header announced
+// length bytes, followed by its checksum when enabled. Frames longer than the
+// maximum frame size are rejected with errFrameTooLarge before any of the
+// payload is read, and corrupted ones with errBadChecksum.
+func readPayload(conn net.Conn, buf []byte, length uint32) ([]byte, error) {
+	if length > uint32(frameSettings.maxLength) {
+		return nil, errFrameTooLarge
+	}
+	payload := buf[:length]
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, err
+	}
+	if frameSettings.checksum {
+		var sum [checksumSize]byte
+		if _, err := io.ReadFull(conn, sum[:]); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(sum[:]) != crc32.Checksum(payload, crcTable) {
+			return nil, errBadChecksum
+		}
+	}
+	return payload, nil
+}
+
+// malformedFrame reports whether err from readPayload means the client sent
+// an invalid frame rather than the connection failing.
+func malformedFrame(err error) bool {
+	return errors.Is(err, errFrameTooLarge) || errors.Is(err, errBadChecksum)
+}
+
+// sendHeartbeats writes a heartbeat frame every heartbeat interval until
+// done is closed or a write fails. It does nothing when heartbeats are
+// disabled.
+func (r *relay) sendHeartbeats(writer *frameWriter, done <-chan struct{}, logger *slog.Logger, metrics *tunnelMetrics) {
+	defer recoverPanic(logger, metrics)
+	if r.heartbeatInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := writer.writeHeartbeat(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// setFrameSettings overrides the framing options for the rest of the test.
+func setFrameSettings(t *testing.T, maxLength int, checksum bool) {
+	t.Helper()
+	saved := frameSettings
+	t.Cleanup(func() { frameSettings = saved })
+	frameSettings.maxLength = maxLength
+	frameSettings.checksum = checksum
+}
+
+func TestReadPayload(t *testing.T) {
+	payload := []byte("datagram")
+	sum := binary.BigEndian.AppendUint32(nil, crc32.Checksum(payload, crcTable))
+	corrupted := binary.BigEndian.AppendUint32(nil, crc32.Checksum(payload, crcTable)^1)
+
+	tests := []struct {
+		name      string
+		maxLength int
+		checksum  bool
+		length    uint32
+		input     []byte
+		wantErr   error
+		malformed bool
+	}{
+		{name: "payload", maxLength: 16, length: 8, input: payload},
+		{name: "empty payload", maxLength: 16, length: 0},
+		{name: "at maximum size", maxLength: 8, length: 8, input: payload},
+		{name: "over maximum size", maxLength: 7, length: 8, input: payload, wantErr: errFrameTooLarge, malformed: true},
+		{name: "oversized length field", maxLength: 16, length: 0xfffffff0, input: payload, wantErr: errFrameTooLarge, malformed: true},
+		{name: "truncated payload", maxLength: 16, length: 8, input: payload[:5], wantErr: io.ErrUnexpectedEOF},
+		{name: "checksum", maxLength: 16, checksum: true, length: 8, input: append(payload, sum...)},
+		{name: "bad checksum", maxLength: 16, checksum: true, length: 8, input: append(payload, corrupted...), wantErr: errBadChecksum, malformed: true},
+		{name: "corrupted payload", maxLength: 16, checksum: true, length: 8, input: append([]byte("datagrab"), sum...), wantErr: errBadChecksum, malformed: true},
+		{name: "truncated checksum", maxLength: 16, checksum: true, length: 8, input: append(payload, sum[:2]...), wantErr: io.ErrUnexpectedEOF},
+		{name: "missing checksum", maxLength: 16, checksum: true, length: 8, input: payload, wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			setFrameSettings(t, tt.maxLength, tt.checksum)
+			client, server := tcpPair(t)
+			go func() {
+				client.Write(tt.input)
+				client.CloseWrite()
+			}()
+
+			buf := make([]byte, tt.maxLength)
+			got, err := readPayload(server, buf, tt.length)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("readPayload() error = %v, want %v", err, tt.wantErr)
+			}
+			if malformedFrame(err) != tt.malformed {
+				t.Errorf("malformedFrame(%v) = %v, want %v", err, !tt.malformed, tt.malformed)
+			}
+			if err == nil && !bytes.Equal(got, tt.input[:tt.length]) {
+				t.Errorf("readPayload() = %q, want %q", got, tt.input[:tt.length])
+			}
+			if errors.Is(err, errFrameTooLarge) {
+				// An oversized frame is rejected before any of it is read.
+				rest, _ := io.ReadAll(server)
+				if !bytes.Equal(rest, tt.input) {
+					t.Errorf("unread data = %q, want %q", rest, tt.input)
+				}
+			}
+		})
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, checksum := range []bool{false, true} {
+		for _, peerID := range []bool{false, true} {
+			setFrameSettings(t, maxDatagramSize, checksum)
+			client, server := tcpPair(t)
+			done := make(chan struct{})
+			writer := newFrameWriter(server, peerID, done, slog.Default(), newTunnelMetrics("test"))
+
+			payloads := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xab}, 1500)}
+			for _, payload := range payloads {
+				if err := writer.writeFrame(7, payload); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.writeHeartbeat(); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.writeFrame(7, []byte("last")); err != nil {
+				t.Fatal(err)
+			}
+			payloads = append(payloads, []byte("last"))
+
+			r := &relay{}
+			header := make([]byte, writer.headerSize())
+			buf := make([]byte, maxDatagramSize)
+			for _, want := range payloads {
+				if err := r.readHeader(client, header); err != nil {
+					t.Fatalf("checksum=%v peerID=%v: readHeader() = %v", checksum, peerID, err)
+				}
+				if peerID && binary.BigEndian.Uint32(header[4:8]) != 7 {
+					t.Errorf("checksum=%v peerID=%v: peer ID = %d, want 7", checksum, peerID, binary.BigEndian.Uint32(header[4:8]))
+				}
+				got, err := readPayload(client, buf, binary.BigEndian.Uint32(header[0:4]))
+				if err != nil {
+					t.Fatalf("checksum=%v peerID=%v: readPayload() = %v", checksum, peerID, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("checksum=%v peerID=%v: payload = %q, want %q", checksum, peerID, got, want)
+				}
+			}
+			close(done)
+		}
+	}
+}
@@ -2,7 +2,37 @@ module kftray-server
 
 go 1.21.3
 
+require github.com/gorilla/mux v1.8.0
 
+require gopkg.in/yaml.v3 v3.0.1
 
-require github.com/gorilla/mux v1.8.0
-require github.com/miladrahimi/gorelay v0.0.0-20230907185746-32f8b7091a10
+require (
+	github.com/gorilla/websocket v1.5.1
+	github.com/klauspost/compress v1.17.7
+	github.com/quic-go/quic-go v0.42.0
+	golang.org/x/time v0.5.0
+)
+
+require (
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/crypto v0.18.0 // indirect
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
+	golang.org/x/mod v0.11.0 // indirect
+	golang.org/x/net v0.20.0 // indirect
+	golang.org/x/tools v0.9.1 // indirect
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/prometheus/client_golang v1.19.1
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/sys v0.17.0
+	google.golang.org/protobuf v1.33.0 // indirect
+)
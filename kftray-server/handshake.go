@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// protocolMagic opens the versioned handshake so a server expecting it can
+// tell a current client from one that speaks the bare tunnel protocol.
+var protocolMagic = []byte("KFTR")
+
+const (
+	// protocolVersion is the tunnel protocol this server speaks, and
+	// minProtocolVersion the oldest one it still accepts.
+	protocolVersion    = 1
+	minProtocolVersion = 1
+
+	versionAccepted = 0x01
+	versionRejected = 0x00
+)
+
+var errNoProtocolHeader = errors.New("client did not send the protocol header; it may predate PROTOCOL_HANDSHAKE")
+
+// handshake runs the per-connection negotiation every stream transport
+// performs before relaying: the protocol version exchange when enabled,
+// authentication, then the compression choice. The returned conn must be
+// used, and closed, in place of conn.
+func (r *relay) handshake(conn net.Conn) (net.Conn, error) {
+	if r.versionHandshake {
+		if err := completeHandshake(conn); err != nil {
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		if err := exchangeVersion(conn); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.security.authenticate(conn); err != nil {
+		return nil, err
+	}
+	return negotiateCompression(conn, r.compression)
+}
+
+// exchangeVersion reads the client's magic header and protocol version and
+// answers with the same magic, the server's version and whether the client's
+// version is accepted, so both sides can report a mismatch clearly.
+func exchangeVersion(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(authTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	header := make([]byte, len(protocolMagic)+1)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read protocol header: %w", err)
+	}
+	if !bytes.Equal(header[:len(protocolMagic)], protocolMagic) {
+		return errNoProtocolHeader
+	}
+	version := header[len(protocolMagic)]
+
+	status := byte(versionAccepted)
+	if version < minProtocolVersion || version > protocolVersion {
+		status = versionRejected
+	}
+	reply := append(append([]byte{}, protocolMagic...), protocolVersion, status)
+	if _, err := conn.Write(reply); err != nil {
+		return fmt.Errorf("failed to send protocol header: %w", err)
+	}
+	if status == versionRejected {
+		return fmt.Errorf("unsupported protocol version %d (server accepts %d to %d)", version, minProtocolVersion, protocolVersion)
+	}
+	return nil
+}
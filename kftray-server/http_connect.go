@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// startHTTPConnectProxy serves as a standard HTTP proxy: CONNECT requests
+// are tunnelled to the requested host, and absolute-form requests for plain
+// http:// URLs are forwarded, so tools honouring HTTPS_PROXY and HTTP_PROXY
+// can reach in-cluster services through one forwarded port.
+func (r *relay) startHTTPConnectProxy(tunnel tunnelConfig) error {
+	logger := slog.With("tunnel", tunnel.Name)
+	listener, err := r.listenStream(tunnel.LocalPort)
+	if err != nil {
+		return fmt.Errorf("failed to start HTTP proxy listener: %w", err)
+	}
+	defer listener.Close()
+	r.closeOnShutdown(listener)
+	r.ready.markReady(tunnel.Name)
+
+	logger.Info("HTTP proxy listening", "port", tunnel.LocalPort, "target", tunnel.targetDescription())
+
+	metrics := newTunnelMetrics(tunnel.Name)
+	forward := &httputil.ReverseProxy{
+		Rewrite:  func(*httputil.ProxyRequest) {},
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelDebug),
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			metrics.error("dial")
+			logger.Error("Failed to forward request", "client", req.RemoteAddr, "target", req.URL.Host, "error", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		release, err := r.admission.admit(remoteAddr(req.RemoteAddr))
+		if err != nil {
+			metrics.error(rejectionKind(err))
+			logger.Warn("Rejected connection", "client", req.RemoteAddr, "error", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		defer release()
+
+		r.sessions.start()
+		defer r.sessions.done()
+
+		if req.Method == http.MethodConnect {
+			logger := withSession(logger)
+			logger.Info("Accepted CONNECT request", "client", req.RemoteAddr, "target", req.Host)
+			r.handleHTTPConnect(w, req, logger, metrics)
+			return
+		}
+		if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+			metrics.error("request")
+			http.Error(w, "only CONNECT and absolute http:// requests are proxied", http.StatusBadRequest)
+			return
+		}
+		metrics.connOpened()
+		defer metrics.connClosed()
+		forward.ServeHTTP(w, req)
+	})
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelDebug),
+	}
+	if err := server.Serve(listener); err != nil && !r.shuttingDown(err) {
+		fatal("HTTP proxy server failed", "tunnel", tunnel.Name, "error", err)
+	}
+	return nil
+}
+
+// handleHTTPConnect dials the CONNECT target, then takes over the client
+// connection and relays it as a raw byte stream.
+func (r *relay) handleHTTPConnect(w http.ResponseWriter, req *http.Request, logger *slog.Logger, metrics *tunnelMetrics) {
+	targetAddr := req.Host
+	if _, _, err := net.SplitHostPort(targetAddr); err != nil {
+		metrics.error("request")
+		http.Error(w, "CONNECT target must be host:port", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+
+	metrics.connOpened()
+	defer metrics.connClosed()
+
+	upstream, err := dialTarget(targetAddr)
+	if err != nil {
+		metrics.error("dial")
+		logger.Error("Failed to connect to target", "target", targetAddr, "error", err)
+		http.Error(w, "failed to connect to target", http.StatusBadGateway)
+		return
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		metrics.error("hijack")
+		logger.Error("Failed to take over connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		upstream.Close()
+		metrics.error("write")
+		logger.Error("Failed to send CONNECT response", "error", err)
+		return
+	}
+
+	logger.Info("Established TCP connection", "target", targetAddr)
+	r.pipe(&bufferedConn{Conn: conn, reader: buffered.Reader}, upstream, logger, metrics)
+}
+
+// bufferedConn reads through the buffer the HTTP server may already have
+// filled from the hijacked connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
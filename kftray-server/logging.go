@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultPayloadLogBytes = 64
+
+// logLevel is shared by every handler so the level can be changed in place.
+var logLevel = new(slog.LevelVar)
+
+// configuredLevel is the level set by LOG_LEVEL, which toggleDebug returns
+// to.
+var configuredLevel slog.Level
+
+// setupLogging installs the default structured logger, configured by
+// LOG_LEVEL (debug, info, warn, error) and LOG_FORMAT (json or text).
+func setupLogging() error {
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL: %s", value)
+		}
+		logLevel.Set(level)
+	}
+	configuredLevel = logLevel.Level()
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT: %s", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return setupPayloadLogging()
+}
+
+// setLogLevel changes the level of every handler at runtime.
+func setLogLevel(level slog.Level) {
+	previous := logLevel.Level()
+	logLevel.Set(level)
+	slog.Warn("Log level changed", "from", previous.String(), "to", level.String())
+}
+
+// toggleDebug switches between debug logging and the configured level.
+func toggleDebug() {
+	if logLevel.Level() == slog.LevelDebug {
+		setLogLevel(configuredLevel)
+	} else {
+		setLogLevel(slog.LevelDebug)
+	}
+}
+
+// payloadLogging configures the opt-in hex dumps of relayed datagrams.
+var payloadLogging struct {
+	enabled bool
+	limit   int
+	redact  [][2]int
+}
+
+// setupPayloadLogging reads LOG_PAYLOADS (true to dump datagrams at debug
+// level), LOG_PAYLOAD_BYTES (how many leading bytes of each datagram to
+// dump) and LOG_PAYLOAD_REDACT (comma-separated start-end byte offsets, end
+// exclusive, that are masked in the dump).
+func setupPayloadLogging() error {
+	payloadLogging.enabled = os.Getenv("LOG_PAYLOADS") == "true"
+	payloadLogging.limit = defaultPayloadLogBytes
+	if value := os.Getenv("LOG_PAYLOAD_BYTES"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return fmt.Errorf("invalid LOG_PAYLOAD_BYTES: %s", value)
+		}
+		payloadLogging.limit = limit
+	}
+
+	payloadLogging.redact = nil
+	for _, spec := range strings.Split(os.Getenv("LOG_PAYLOAD_REDACT"), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		startStr, endStr, _ := strings.Cut(spec, "-")
+		start, err1 := strconv.Atoi(startStr)
+		end, err2 := strconv.Atoi(endStr)
+		if err1 != nil || err2 != nil || start < 0 || end <= start {
+			return fmt.Errorf("invalid LOG_PAYLOAD_REDACT range: %s", spec)
+		}
+		payloadLogging.redact = append(payloadLogging.redact, [2]int{start, end})
+	}
+	return nil
+}
+
+// payloadAttr returns the truncated, redacted hex dump of p as a log
+// attribute, or an empty attribute, which handlers omit, unless payload
+// logging is enabled at debug level.
+func payloadAttr(p []byte) slog.Attr {
+	if !payloadLogging.enabled || logLevel.Level() > slog.LevelDebug {
+		return slog.Attr{}
+	}
+
+	truncated := len(p) > payloadLogging.limit
+	if truncated {
+		p = p[:payloadLogging.limit]
+	}
+	dump := []byte(hex.EncodeToString(p))
+	for _, r := range payloadLogging.redact {
+		for i := r[0]; i < r[1] && i < len(p); i++ {
+			dump[2*i], dump[2*i+1] = '*', '*'
+		}
+	}
+	if truncated {
+		dump = append(dump, "..."...)
+	}
+	return slog.String("payload", string(dump))
+}
+
+// fatal logs msg at error level and exits with exitRuntime.
+func fatal(msg string, args ...any) {
+	exit(exitRuntime, msg, args...)
+}
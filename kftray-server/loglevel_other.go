@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLogLevelSignal toggles debug logging on each SIGUSR1 until ctx ends,
+// so a transient issue can be captured without a restart.
+func watchLogLevelSignal(ctx context.Context) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-usr1:
+			toggleDebug()
+		}
+	}
+}
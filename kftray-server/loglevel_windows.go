@@ -0,0 +1,7 @@
+package main
+
+import "context"
+
+// watchLogLevelSignal does nothing on Windows, which has no SIGUSR1; the
+// admin /loglevel endpoint changes the level instead.
+func watchLogLevelSignal(context.Context) {}
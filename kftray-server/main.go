@@ -1,143 +1,465 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
-
-	"github.com/miladrahimi/gorelay"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 func main() {
-	targetHost := os.Getenv("REMOTE_ADDRESS")
-	targetPortStr := os.Getenv("REMOTE_PORT")
-	proxyPortStr := os.Getenv("LOCAL_PORT")
-	proxyType := os.Getenv("PROXY_TYPE")
+	if len(os.Args) > 1 && os.Args[1] == "manifest" {
+		runManifest(os.Args[2:])
+		return
+	}
 
-	log.Printf("Configured REMOTE_ADDRESS: %s", targetHost)
-	log.Printf("Configured REMOTE_PORT: %s", targetPortStr)
-	log.Printf("Configured LOCAL_PORT: %s", proxyPortStr)
-	log.Printf("Configured PROXY_TYPE: %s", proxyType)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
 
-	targetPort, err := strconv.Atoi(targetPortStr)
-	if err != nil {
-		log.Fatalf("Invalid REMOTE_PORT: %s", targetPortStr)
+	if err := setupLogging(); err != nil {
+		exit(exitConfig, "Invalid logging configuration", "error", err)
 	}
 
-	proxyPort, err := strconv.Atoi(proxyPortStr)
-	if err != nil {
-		log.Fatalf("Invalid LOCAL_PORT: %s", proxyPortStr)
+	if *selfTestFlag {
+		if err := runSelfTest(); err != nil {
+			fatal("Self-test failed", "error", err)
+		}
+		return
 	}
 
-	switch proxyType {
-	case "tcp":
-		tcp := gorelay.NewTcpRelay()
-		err := tcp.Relay(proxyPort, targetPort, targetHost)
-		if err != nil {
-			log.Fatalf("Failed to start the TCP proxy server: %s", err)
+	// Every setting is checked before any is acted on, so all problems
+	// are reported in one run.
+	var problems startupProblems
+
+	tunnels, err := loadTunnels()
+	problems.add(err)
+
+	tlsConfig, err := loadTLSConfig()
+	problems.addCredentials(err)
+
+	psk, err := loadPSK()
+	problems.addCredentials(err)
+
+	brokerTLS, err := loadBrokerTLSConfig(tlsConfig)
+	problems.addCredentials(err)
+
+	adminPort, err := loadAdminPort(tunnels)
+	problems.add(err)
+
+	adminPprof, err := loadAdminPprof(adminPort)
+	problems.add(err)
+
+	listenHost, err := loadListenHost()
+	problems.add(err)
+
+	shutdownTimeout, err := durationFromEnv("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	problems.add(err)
+
+	udpIdleTimeout, err := durationFromEnv("UDP_SESSION_TIMEOUT", defaultUDPIdleTimeout)
+	problems.add(err)
+
+	heartbeatInterval, err := durationFromEnv("HEARTBEAT_INTERVAL", 0)
+	problems.add(err)
+
+	dnsRefreshInterval, err := durationFromEnv("DNS_REFRESH_INTERVAL", defaultDNSRefreshInterval)
+	problems.add(err)
+
+	healthCheckInterval, err := durationFromEnv("HEALTH_CHECK_INTERVAL", defaultHealthCheckInterval)
+	problems.add(err)
+
+	versionHandshake := os.Getenv("PROTOCOL_HANDSHAKE") == "true"
+
+	reloadInterval, err := durationFromEnv("CONFIG_RELOAD_INTERVAL", 0)
+	problems.add(err)
+
+	admission, err := loadAdmissionControl()
+	problems.add(err)
+
+	problems.add(setupBuffers())
+	problems.add(setupFraming())
+	problems.add(setupSocketOptions())
+	problems.add(setupTimeouts())
+	problems.add(setupAccessLog())
+
+	hotRestartSocket, err := loadHotRestart()
+	problems.add(err)
+
+	problems.add(setupCrashDumps())
+
+	compression, err := loadCompression()
+	problems.add(err)
+
+	proxyProtocol, err := loadProxyProtocol()
+	problems.add(err)
+
+	r := &relay{
+		listenHost:          listenHost,
+		security:            transportSecurity{tlsConfig: tlsConfig, psk: psk, brokerTLS: brokerTLS},
+		ready:               newReadiness(),
+		sessions:            new(sessionTracker),
+		admission:           admission,
+		udpIdleTimeout:      udpIdleTimeout,
+		compression:         compression,
+		heartbeatInterval:   heartbeatInterval,
+		versionHandshake:    versionHandshake,
+		dnsRefreshInterval:  dnsRefreshInterval,
+		proxyProtocol:       proxyProtocol,
+		healthCheckInterval: healthCheckInterval,
+	}
+
+	problems.add(r.checkSupported(tunnels))
+	problems.exitIfAny()
+	r.logEffectiveConfig(tunnels, adminPort, adminPprof, shutdownTimeout, reloadInterval)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	serviceStopped := startService(stop)
+	r.ctx = ctx
+
+	manager := newTunnelManager(r)
+	if err := manager.apply(tunnels); err != nil {
+		fatal("Failed to start tunnels", "error", err)
+	}
+	go manager.watch(reloadInterval)
+
+	if adminPort != 0 {
+		r.startAdminServer(adminPort, adminPprof)
+	}
+	go r.notifyReady()
+	go watchLogLevelSignal(ctx)
+	// handedOff is set once a newer process has taken over through the hot
+	// restart socket, so this one drains its sessions without a time limit.
+	var handedOff atomic.Bool
+	if hotRestartSocket != "" {
+		go r.serveHotRestart(hotRestartSocket, func() {
+			handedOff.Store(true)
+			stop()
+		})
+	}
+
+	<-ctx.Done()
+	stop()
+	r.ready.setDraining()
+	notifySystemd("STOPPING=1")
+	var drained bool
+	if handedOff.Load() {
+		drained = r.drainHandedOff(shutdownTimeout)
+	} else {
+		slog.Info("Shutting down", "timeout", shutdownTimeout.String(), "active_sessions", r.sessions.active.Load())
+		drained = r.sessions.wait(shutdownTimeout)
+	}
+	if drained {
+		slog.Info("All sessions closed")
+	} else {
+		slog.Warn("Shutdown timeout expired", "active_sessions", r.sessions.active.Load())
+	}
+	os.Stderr.Sync()
+	serviceStopped()
+}
+
+// relay holds the state shared by every tunnel served by this process.
+type relay struct {
+	ctx        context.Context
+	listenHost string
+	security   transportSecurity
+	ready      *readiness
+	admission  *admissionControl
+	sessions   *sessionTracker
+
+	// udpIdleTimeout closes UDP sessions without traffic in either
+	// direction for this long. Zero keeps them open indefinitely.
+	udpIdleTimeout time.Duration
+
+	// compression is the mask of algorithms offered to clients after
+	// authentication; compressionNone skips the negotiation.
+	compression byte
+
+	// heartbeatInterval is how often heartbeat frames are sent on udp and
+	// udp-mux tunnels; clients that miss heartbeatMisses of them in a row
+	// are disconnected. Zero disables heartbeats.
+	heartbeatInterval time.Duration
+
+	// versionHandshake requires stream clients to open with the magic
+	// header and protocol version before authenticating.
+	versionHandshake bool
+
+	// dnsRefreshInterval is how long a resolved UDP target address is
+	// reused before it is looked up again.
+	dnsRefreshInterval time.Duration
+
+	// proxyProtocol selects whether PROXY headers are read from clients of
+	// TCP listeners and written to TCP targets.
+	proxyProtocol proxyProtocol
+
+	// healthCheckInterval is how often the targets of stream tunnels with
+	// several targets are probed. Zero disables health checks.
+	healthCheckInterval time.Duration
+}
+
+// closeOnShutdown closes c once the relay starts shutting down, which stops
+// the accept or read loop blocked on it.
+func (r *relay) closeOnShutdown(c io.Closer) {
+	go func() {
+		<-r.ctx.Done()
+		c.Close()
+	}()
+}
+
+// listenAddr is the address listeners bind to for port.
+func (r *relay) listenAddr(port int) string {
+	return net.JoinHostPort(r.listenHost, strconv.Itoa(port))
+}
+
+func (r *relay) shuttingDown(err error) bool {
+	return r.ctx.Err() != nil && errors.Is(err, net.ErrClosed)
+}
+
+// checkSupported rejects tunnels whose proxy type cannot apply the
+// configured transport options.
+func (r *relay) checkSupported(tunnels []tunnelConfig) error {
+	for _, tunnel := range tunnels {
+		switch tunnel.ProxyType {
+		case "udp-native":
+			if r.security.enabled() || r.compression != compressionNone || r.versionHandshake {
+				return fmt.Errorf("tunnel %q: TLS, AUTH_PSK, COMPRESSION and PROTOCOL_HANDSHAKE are not supported with proxy_type %s", tunnel.Name, tunnel.ProxyType)
+			}
+		case "reverse":
+			if r.compression != compressionNone || r.versionHandshake {
+				return fmt.Errorf("tunnel %q: COMPRESSION and PROTOCOL_HANDSHAKE are not supported with proxy_type %s", tunnel.Name, tunnel.ProxyType)
+			}
+		case "http-connect":
+			if r.security.psk != nil || r.compression != compressionNone || r.versionHandshake {
+				return fmt.Errorf("tunnel %q: AUTH_PSK, COMPRESSION and PROTOCOL_HANDSHAKE are not supported with proxy_type %s", tunnel.Name, tunnel.ProxyType)
+			}
 		}
-	case "udp":
-		startUDPOverTCPProxy(targetHost, targetPort, proxyPort)
-	default:
-		log.Fatalf("Unsupported PROXY_TYPE: %s", proxyType)
 	}
+	return nil
+}
+
+// runTunnel serves tunnel until its relay's context ends. It returns an
+// error, before the tunnel is marked ready, when the tunnel cannot start
+// listening.
+func (r *relay) runTunnel(tunnel tunnelConfig) error {
+	logger := slog.With("tunnel", tunnel.Name)
+	logger.Info("Starting tunnel", "proxy_type", tunnel.ProxyType, "local_port", tunnel.LocalPort, "target", tunnel.targetDescription())
+
+	switch tunnel.ProxyType {
+	case "tcp":
+		return r.startTCPProxy(tunnel)
+	case "udp", "udp-mux":
+		return r.startUDPOverTCPProxy(tunnel)
+	case "udp-native":
+		return r.startNativeUDPProxy(tunnel)
+	case "ws":
+		return r.startWebSocketProxy(tunnel)
+	case "quic":
+		return r.startQUICProxy(tunnel)
+	case "socks5":
+		return r.startSOCKS5Proxy(tunnel)
+	case "http-connect":
+		return r.startHTTPConnectProxy(tunnel)
+	case "reverse":
+		return r.startReverseTunnel(tunnel)
+	}
+	return nil
 }
 
-func startUDPOverTCPProxy(targetHost string, targetPort, proxyPort int) {
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(proxyPort))
+func (r *relay) startUDPOverTCPProxy(tunnel tunnelConfig) error {
+	logger := slog.With("tunnel", tunnel.Name)
+	listener, err := r.listenStream(tunnel.LocalPort)
 	if err != nil {
-		log.Fatalf("Failed to start TCP listener: %s", err)
+		return fmt.Errorf("failed to start TCP listener: %w", err)
 	}
 	defer listener.Close()
+	r.closeOnShutdown(listener)
+	r.ready.markReady(tunnel.Name)
 
-	log.Printf("UDP over TCP proxy listening on port %d", proxyPort)
+	logger.Info("UDP over TCP proxy listening", "port", tunnel.LocalPort)
 
+	metrics := newTunnelMetrics(tunnel.Name)
+	targets := r.targetsFor(tunnel, logger)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %s", err)
+			if r.shuttingDown(err) {
+				return nil
+			}
+			metrics.error("accept")
+			logger.Error("Failed to accept connection", "error", err)
+			continue
+		}
+		release, err := r.admission.admit(conn.RemoteAddr())
+		if err != nil {
+			metrics.error(rejectionKind(err))
+			logger.Warn("Rejected connection", "client", conn.RemoteAddr().String(), "error", err)
+			conn.Close()
 			continue
 		}
-		go handleTCPConnection(conn, targetHost, targetPort)
+		r.sessions.start()
+		go func() {
+			defer r.sessions.done()
+			defer release()
+			defer recoverPanic(logger, metrics)
+			r.handleTCPConnection(conn, tunnel, targets, metrics)
+		}()
 	}
 }
 
-func handleTCPConnection(conn net.Conn, targetHost string, targetPort int) {
+func (r *relay) handleTCPConnection(conn net.Conn, tunnel tunnelConfig, targets *targetPool, metrics *tunnelMetrics) {
 	defer conn.Close()
-	clientAddr := conn.RemoteAddr().String()
-	log.Printf("Accepted TCP connection from %s", clientAddr)
+	logger := withSession(slog.With("tunnel", tunnel.Name))
+	logger.Info("Accepted TCP connection", "client", conn.RemoteAddr().String())
 
-	udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(targetHost, strconv.Itoa(targetPort)))
+	conn, err := r.handshake(conn)
 	if err != nil {
-		log.Printf("[%s] Failed to resolve UDP address: %s", clientAddr, err)
+		metrics.error("auth")
+		logger.Warn("Rejected connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	metrics.connOpened()
+	defer metrics.connClosed()
+
+	if tunnel.ProxyType == "udp-mux" {
+		r.handleMuxConnection(conn, targets, logger, metrics)
+		return
+	}
+
+	target, err := targets.pick()
+	if err != nil {
+		metrics.error("resolve")
+		logger.Error("Failed to resolve UDP address", "error", err)
+		return
+	}
+	resolver := target.resolver
+	udpAddr, err := resolver.resolve()
+	if err != nil {
+		metrics.error("resolve")
+		logger.Error("Failed to resolve UDP address", "error", err)
 		return
 	}
 
 	udpConn, err := net.DialUDP("udp", nil, udpAddr)
 	if err != nil {
-		log.Printf("[%s] Failed to dial UDP: %s", clientAddr, err)
+		resolver.invalidate()
+		metrics.error("dial")
+		logger.Error("Failed to dial UDP", "error", err)
 		return
 	}
 	defer udpConn.Close()
-	log.Printf("[%s] Established UDP connection to %s", clientAddr, udpAddr)
+	tuneConn(udpConn)
+	metrics, untrack := r.sessions.track(metrics, conn.RemoteAddr().String(), udpAddr.String())
+	defer untrack()
+	metrics.sessions.Inc()
+	defer metrics.sessions.Dec()
+	logger.Info("Established UDP connection", "target", udpAddr.String())
+
+	var session activity
+	session.touch()
+
+	done := make(chan struct{})
+	defer close(done)
+	writer := newFrameWriter(conn, false, done, logger, metrics)
+	go r.sendHeartbeats(writer, done, logger, metrics)
 
 	// Forward TCP to UDP
 	go func() {
+		defer recoverPanic(logger, metrics)
 		defer udpConn.Close()
+		buf := datagramBuffers.get()
+		defer datagramBuffers.put(buf)
 		for {
 			// Read the length of the UDP packet from the TCP stream
 			var lengthBytes [4]byte
-			_, err := io.ReadFull(conn, lengthBytes[:])
+			err := r.readHeader(conn, lengthBytes[:])
 			if err != nil {
-				if err != io.EOF {
-					log.Printf("[%s] Error reading packet length from TCP: %s", clientAddr, err)
+				if isTimeout(err) {
+					metrics.error("heartbeat")
+					logger.Warn("Closing connection after missed heartbeats", "interval", r.heartbeatInterval.String())
+				} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+					metrics.error("read")
+					logger.Error("Error reading packet length from TCP", "error", err)
 				}
 				return
 			}
 			length := binary.BigEndian.Uint32(lengthBytes[:])
-
-			buf := make([]byte, length) // Create a buffer with the exact packet size
-			_, err = io.ReadFull(conn, buf)
+			packet, err := readPayload(conn, *buf, length)
+			if malformedFrame(err) {
+				metrics.error("frame")
+				logger.Error("Closing connection after malformed frame", "bytes", length, "error", err)
+				return
+			}
 			if err != nil {
-				log.Printf("[%s] Error reading from TCP: %s", clientAddr, err)
+				metrics.error("read")
+				logger.Error("Error reading from TCP", "error", err)
 				return
 			}
-			log.Printf("[%s] TCP -> UDP: %x", clientAddr, buf)
+			logger.Debug("TCP -> UDP", "bytes", length, payloadAttr(packet))
 
-			_, err = udpConn.Write(buf)
+			_, err = udpConn.Write(packet)
 			if err != nil {
-				log.Printf("[%s] Error writing to UDP: %s", clientAddr, err)
+				resolver.invalidate()
+				metrics.error("write")
+				logger.Error("Error writing to UDP", "error", err)
 				return
 			}
+			metrics.relayedToTarget(int(length))
+			session.touch()
 		}
 	}()
 
 	// Forward UDP to TCP
-	buf := make([]byte, 65535) // UDP max packet size
+	buf := datagramBuffers.get()
+	defer datagramBuffers.put(buf)
 	for {
-		n, _, err := udpConn.ReadFromUDP(buf)
+		session.setIdleDeadline(udpConn, r.udpIdleTimeout)
+		n, _, err := udpConn.ReadFromUDP((*buf)[:bufferSettings.maxDatagram])
 		if err != nil {
-			log.Printf("[%s] Error reading from UDP: %s", clientAddr, err)
+			if isTimeout(err) {
+				if session.idle() < r.udpIdleTimeout {
+					continue
+				}
+				metrics.ended("idle")
+				logger.Info("Closing idle UDP session", "idle_timeout", r.udpIdleTimeout.String())
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			resolver.invalidate()
+			metrics.error("read")
+			logger.Error("Error reading from UDP", "error", err)
 			return
 		}
-		log.Printf("[%s] UDP -> TCP: %x", clientAddr, buf[:n])
+		logger.Debug("UDP -> TCP", "bytes", n, payloadAttr((*buf)[:n]))
 
 		// Prepend the length of the UDP packet to the data sent over TCP
-		lengthBytes := make([]byte, 4)
-		binary.BigEndian.PutUint32(lengthBytes, uint32(n))
-		_, err = conn.Write(lengthBytes)
-		if err != nil {
-			log.Printf("[%s] Error writing packet length to TCP: %s", clientAddr, err)
-			return
+		err = writer.writeFrame(0, (*buf)[:n])
+		if errors.Is(err, errMemoryLimit) {
+			metrics.error("memory")
+			logger.Debug("Dropped datagram at buffer memory limit", "bytes", n)
+			continue
 		}
-
-		_, err = conn.Write(buf[:n])
 		if err != nil {
-			log.Printf("[%s] Error writing to TCP: %s", clientAddr, err)
+			metrics.error("write")
+			logger.Error("Error writing to TCP", "error", err)
 			return
 		}
+		metrics.relayedToClient(n)
+		session.touch()
 	}
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// newTestRelay returns a relay with default settings whose context ends
+// when the test does.
+func newTestRelay(t *testing.T) *relay {
+	t.Helper()
+	admission, err := loadAdmissionControl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &relay{
+		ctx:            ctx,
+		ready:          newReadiness(),
+		sessions:       new(sessionTracker),
+		admission:      admission,
+		udpIdleTimeout: defaultUDPIdleTimeout,
+	}
+}
+
+// runTestTunnel starts tunnel and waits until it is listening.
+func runTestTunnel(t *testing.T, r *relay, tunnel tunnelConfig) {
+	t.Helper()
+	r.ready.add(tunnel.Name)
+	go r.runTunnel(tunnel)
+	if err := waitReady(r.ready); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func requireIPv6(t *testing.T) {
+	t.Helper()
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	listener.Close()
+}
+
+// startEcho serves a TCP echo server on addr until the test ends.
+func startEcho(t *testing.T, network, addr string) net.Listener {
+	t.Helper()
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+// startEchoTunnel runs a tunnel of proxyType on r to a new echo server and
+// returns the address clients connect to.
+func startEchoTunnel(t *testing.T, r *relay, proxyType string) string {
+	t.Helper()
+	echo := startEcho(t, "tcp", "127.0.0.1:0")
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestTunnel(t, r, tunnelConfig{
+		Name:          proxyType,
+		LocalPort:     port,
+		RemoteAddress: "127.0.0.1",
+		RemotePort:    echo.Addr().(*net.TCPAddr).Port,
+		ProxyType:     proxyType,
+	})
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+func echoRoundTrip(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return echoOver(conn)
+}
+
+// echoOver sends a message on conn and checks that it is echoed back.
+func echoOver(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	want := []byte("ping " + conn.RemoteAddr().String())
+	if _, err := conn.Write(want); err != nil {
+		return err
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return err
+	}
+	if string(got) != string(want) {
+		return fmt.Errorf("echoed %q, want %q", got, want)
+	}
+	return nil
+}
+
+// tcpPair returns both ends of a loopback TCP connection, closed when the
+// test ends.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
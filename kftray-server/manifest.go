@@ -0,0 +1,257 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const defaultManifestImage = "docker.io/hcavarsan/kftray-server:latest"
+
+// manifestTemplate renders a Deployment, and a Service and NetworkPolicy
+// for it, running the relay with one tunnel. Values are quoted by the
+// template's quote function.
+var manifestTemplate = template.Must(template.New("manifest").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{quote .Name}}
+  namespace: {{quote .Namespace}}
+  labels:
+    app: {{quote .Name}}
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: {{quote .Name}}
+  template:
+    metadata:
+      labels:
+        app: {{quote .Name}}
+    spec:
+      containers:
+        - name: kftray-server
+          image: {{quote .Image}}
+          env:
+{{- range .Env}}
+            - name: {{.Name}}
+              value: {{quote .Value}}
+{{- end}}
+{{- if .Ports}}
+          ports:
+{{- range .Ports}}
+            - name: {{.Name}}
+              containerPort: {{.Port}}
+              protocol: {{.Protocol}}
+{{- end}}
+{{- end}}
+{{- if .AdminPort}}
+          livenessProbe:
+            httpGet:
+              path: /healthz
+              port: admin
+          readinessProbe:
+            httpGet:
+              path: /readyz
+              port: admin
+{{- end}}
+{{- if .ServicePorts}}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{quote .Name}}
+  namespace: {{quote .Namespace}}
+  labels:
+    app: {{quote .Name}}
+spec:
+  selector:
+    app: {{quote .Name}}
+  ports:
+{{- range .ServicePorts}}
+    - name: {{.Name}}
+      port: {{.Port}}
+      targetPort: {{.Name}}
+      protocol: {{.Protocol}}
+{{- end}}
+{{- end}}
+---
+apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: {{quote .Name}}
+  namespace: {{quote .Namespace}}
+spec:
+  podSelector:
+    matchLabels:
+      app: {{quote .Name}}
+  policyTypes:
+    - Ingress
+    - Egress
+  ingress:
+{{- if .Ports}}
+    - ports:
+{{- range .Ports}}
+        - port: {{.Port}}
+          protocol: {{.Protocol}}
+{{- end}}
+{{- else}} []
+{{- end}}
+  egress:
+    - ports:
+        - port: 53
+          protocol: UDP
+        - port: 53
+          protocol: TCP
+{{- if .EgressPorts}}
+    - ports:
+{{- range .EgressPorts}}
+        - port: {{.Port}}
+          protocol: {{.Protocol}}
+{{- end}}
+{{- else}}
+    - {}
+{{- end}}
+`))
+
+type manifestEnv struct {
+	Name  string
+	Value string
+}
+
+type manifestPort struct {
+	Name     string
+	Port     int
+	Protocol string
+}
+
+type manifestValues struct {
+	Name         string
+	Namespace    string
+	Image        string
+	AdminPort    int
+	Env          []manifestEnv
+	Ports        []manifestPort
+	ServicePorts []manifestPort
+	EgressPorts  []manifestPort
+}
+
+// runManifest implements the manifest subcommand, which prints Kubernetes
+// manifests that run the relay with the tunnel described by the usual
+// tunnel flags.
+func runManifest(args []string) {
+	flags := flag.NewFlagSet("manifest", flag.ExitOnError)
+	name := flags.String("name", "kftray-server", "name of the Deployment, Service and NetworkPolicy")
+	namespace := flags.String("namespace", "default", "namespace to deploy into")
+	image := flags.String("image", defaultManifestImage, "relay container image")
+	adminPort := flags.Int("admin-port", 0, "port for the health probes and metrics, 0 to omit them")
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" {
+			flags.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage: %s manifest [flags]\n\n", os.Args[0])
+		fmt.Fprintf(out, "Prints a Deployment, Service and NetworkPolicy running the relay with one tunnel.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+
+	// Only report problems; the manifest itself goes to stdout.
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	tunnel, err := loadTunnelFromSettings()
+	if err == nil {
+		err = tunnel.validate()
+	}
+	if err == nil && (*adminPort < 0 || *adminPort > 65535 || (*adminPort != 0 && *adminPort == tunnel.LocalPort)) {
+		err = fmt.Errorf("invalid admin port: %d", *adminPort)
+	}
+	if err != nil {
+		exit(exitConfig, "Invalid configuration", "error", err)
+	}
+
+	values := manifestValues{Name: *name, Namespace: *namespace, Image: *image, AdminPort: *adminPort}
+	if err := writeManifest(os.Stdout, tunnel, values); err != nil {
+		fatal("Failed to write manifest", "error", err)
+	}
+}
+
+func writeManifest(w io.Writer, tunnel tunnelConfig, values manifestValues) error {
+	values.Env = []manifestEnv{{"PROXY_TYPE", tunnel.ProxyType}}
+	if tunnel.LocalPort != 0 {
+		values.Env = append(values.Env, manifestEnv{"LOCAL_PORT", strconv.Itoa(tunnel.LocalPort)})
+	}
+	if tunnel.RemoteAddress != "" {
+		values.Env = append(values.Env, manifestEnv{"REMOTE_ADDRESS", tunnel.RemoteAddress})
+	}
+	if tunnel.RemotePort != 0 {
+		values.Env = append(values.Env, manifestEnv{"REMOTE_PORT", strconv.Itoa(tunnel.RemotePort)})
+	}
+	if tunnel.ConnectAddress != "" {
+		values.Env = append(values.Env, manifestEnv{"CONNECT_ADDRESS", tunnel.ConnectAddress})
+	}
+
+	if tunnel.LocalPort != 0 {
+		protocol := "TCP"
+		if tunnel.ProxyType == "udp-native" || tunnel.ProxyType == "quic" {
+			protocol = "UDP"
+		}
+		values.Ports = append(values.Ports, manifestPort{"tunnel", tunnel.LocalPort, protocol})
+		values.ServicePorts = append(values.ServicePorts, manifestPort{"tunnel", tunnel.LocalPort, protocol})
+	}
+	if values.AdminPort != 0 {
+		values.Env = append(values.Env, manifestEnv{"ADMIN_PORT", strconv.Itoa(values.AdminPort)})
+		values.Ports = append(values.Ports, manifestPort{"admin", values.AdminPort, "TCP"})
+	}
+	values.EgressPorts = egressPorts(tunnel)
+	return manifestTemplate.Execute(w, values)
+}
+
+// egressPorts returns the ports the tunnel connects out to, or nil when they
+// are chosen by clients or SRV records and egress cannot be narrowed.
+func egressPorts(tunnel tunnelConfig) []manifestPort {
+	if tunnel.dynamicTarget() {
+		return nil
+	}
+	protocol := "TCP"
+	if tunnel.datagramTarget() {
+		protocol = "UDP"
+	}
+
+	var ports []manifestPort
+	seen := make(map[string]bool)
+	add := func(port int, protocol string) {
+		key := fmt.Sprintf("%d/%s", port, protocol)
+		if !seen[key] {
+			seen[key] = true
+			ports = append(ports, manifestPort{Port: port, Protocol: protocol})
+		}
+	}
+	for _, spec := range splitTargets(tunnel.RemoteAddress) {
+		if strings.HasPrefix(spec, srvPrefix) {
+			return nil
+		}
+		port := tunnel.RemotePort
+		if _, portStr, err := net.SplitHostPort(spec); err == nil {
+			port, _ = strconv.Atoi(portStr)
+		}
+		add(port, protocol)
+	}
+	if tunnel.ConnectAddress != "" {
+		_, portStr, _ := net.SplitHostPort(tunnel.ConnectAddress)
+		port, _ := strconv.Atoi(portStr)
+		add(port, "TCP")
+	}
+	return ports
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	directionToTarget = "to_target"
+	directionToClient = "to_client"
+)
+
+var (
+	activeConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kftray_server_active_connections",
+		Help: "Number of client connections currently being relayed.",
+	}, []string{"tunnel"})
+
+	connectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kftray_server_connections_total",
+		Help: "Total number of client connections accepted.",
+	}, []string{"tunnel"})
+
+	bytesRelayed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kftray_server_bytes_total",
+		Help: "Total number of payload bytes relayed, by direction.",
+	}, []string{"tunnel", "direction"})
+
+	udpSessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kftray_server_udp_sessions",
+		Help: "Number of UDP sessions currently open to the target.",
+	}, []string{"tunnel"})
+
+	relayErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kftray_server_errors_total",
+		Help: "Total number of relay errors, by kind.",
+	}, []string{"tunnel", "kind"})
+)
+
+// tunnelMetrics is the set of metric children for a single tunnel, resolved
+// once so the relay paths don't pay for label lookups per packet.
+type tunnelMetrics struct {
+	tunnel   string
+	active   prometheus.Gauge
+	accepted prometheus.Counter
+	toTarget prometheus.Counter
+	toClient prometheus.Counter
+	sessions prometheus.Gauge
+
+	// session, when set, also receives the byte counts of the one session
+	// these metrics were handed to.
+	session *sessionStats
+}
+
+func newTunnelMetrics(tunnel string) *tunnelMetrics {
+	return &tunnelMetrics{
+		tunnel:   tunnel,
+		active:   activeConnections.WithLabelValues(tunnel),
+		accepted: connectionsTotal.WithLabelValues(tunnel),
+		toTarget: bytesRelayed.WithLabelValues(tunnel, directionToTarget),
+		toClient: bytesRelayed.WithLabelValues(tunnel, directionToClient),
+		sessions: udpSessions.WithLabelValues(tunnel),
+	}
+}
+
+func (m *tunnelMetrics) connOpened() {
+	m.accepted.Inc()
+	m.active.Inc()
+}
+
+func (m *tunnelMetrics) connClosed() {
+	m.active.Dec()
+}
+
+// error counts an error of kind, which also becomes the close reason of the
+// session these metrics belong to, if any.
+func (m *tunnelMetrics) error(kind string) {
+	relayErrors.WithLabelValues(m.tunnel, kind).Inc()
+	m.ended(kind)
+}
+
+// ended records reason as the close reason of the session these metrics
+// belong to, if any.
+func (m *tunnelMetrics) ended(reason string) {
+	if m.session != nil {
+		m.session.setReason(reason)
+	}
+}
+
+// forSession returns a copy of the metrics that also counts bytes for stats.
+func (m *tunnelMetrics) forSession(stats *sessionStats) *tunnelMetrics {
+	session := *m
+	session.session = stats
+	return &session
+}
+
+func (m *tunnelMetrics) relayedToTarget(n int) {
+	m.toTarget.Add(float64(n))
+	if m.session != nil {
+		m.session.toTarget.Add(int64(n))
+	}
+}
+
+func (m *tunnelMetrics) relayedToClient(n int) {
+	m.toClient.Add(float64(n))
+	if m.session != nil {
+		m.session.toClient.Add(int64(n))
+	}
+}
+
+// countingWriter reports the number of bytes written through it.
+type countingWriter struct {
+	w     io.Writer
+	count func(int)
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count(n)
+	return n, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const readinessPollInterval = 100 * time.Millisecond
+
+// notifySystemd sends state to the systemd notification socket named by
+// NOTIFY_SOCKET, as sd_notify(3) does. It does nothing when the relay is not
+// run by systemd with Type=notify.
+func notifySystemd(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("Failed to notify systemd", "state", state, "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("Failed to notify systemd", "state", state, "error", err)
+	}
+}
+
+// waitForTunnels blocks until every tunnel has bound its listener, and
+// reports false if the relay shut down first.
+func (r *relay) waitForTunnels() bool {
+	ticker := time.NewTicker(readinessPollInterval)
+	defer ticker.Stop()
+	for len(r.ready.notReady()) > 0 {
+		select {
+		case <-r.ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// notifyReady tells systemd the relay is ready once every tunnel has bound
+// its listener, and then pings the systemd watchdog at half the interval
+// set by WatchdogSec until shutdown.
+func (r *relay) notifyReady() {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	if !r.waitForTunnels() {
+		return
+	}
+	notifySystemd("READY=1")
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	watchdog := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer watchdog.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-watchdog.C:
+			notifySystemd("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+
+	// proxyV1MaxLength is the longest v1 header allowed by the spec,
+	// including the trailing CRLF.
+	proxyV1MaxLength = 107
+
+	proxyV2CommandLocal = 0x20
+	proxyV2CommandProxy = 0x21
+	proxyV2FamilyUnspec = 0x00
+	proxyV2FamilyTCP4   = 0x11
+	proxyV2FamilyTCP6   = 0x21
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocol selects where PROXY protocol headers are used. accept
+// requires every client of a TCP listener to open with a v1 or v2 header,
+// whose source address then stands in for the client address. send writes a
+// v2 header carrying the client address to TCP targets.
+type proxyProtocol struct {
+	accept bool
+	send   bool
+
+	// trusted lists the networks of the load balancers allowed to send
+	// headers. Connections from anywhere else are rejected, since their
+	// header could claim any address to get past ALLOWED_CIDRS and
+	// RATE_LIMIT.
+	trusted []*net.IPNet
+}
+
+// loadProxyProtocol reads the comma-separated PROXY_PROTOCOL list (accept,
+// send), both off when it is unset, and PROXY_PROTOCOL_TRUSTED_CIDRS, which
+// accept requires.
+func loadProxyProtocol() (proxyProtocol, error) {
+	var p proxyProtocol
+	for _, name := range strings.Split(os.Getenv("PROXY_PROTOCOL"), ",") {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "":
+		case "accept":
+			p.accept = true
+		case "send":
+			p.send = true
+		default:
+			return proxyProtocol{}, fmt.Errorf("invalid PROXY_PROTOCOL: %s", name)
+		}
+	}
+
+	trusted, err := cidrsFromEnv("PROXY_PROTOCOL_TRUSTED_CIDRS")
+	if err != nil {
+		return proxyProtocol{}, err
+	}
+	switch {
+	case p.accept && trusted == nil:
+		return proxyProtocol{}, errors.New("PROXY_PROTOCOL=accept requires PROXY_PROTOCOL_TRUSTED_CIDRS")
+	case !p.accept && trusted != nil:
+		return proxyProtocol{}, errors.New("PROXY_PROTOCOL_TRUSTED_CIDRS requires PROXY_PROTOCOL=accept")
+	}
+	p.trusted = trusted
+	return p, nil
+}
+
+// proxyProtocolListener reads the PROXY header of each connection accepted
+// from a trusted network in its own goroutine, so slow clients don't hold
+// up the accept loop, and hands out the connections whose header was valid.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	conns   chan net.Conn
+	errs    chan error
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newProxyProtocolListener(listener net.Listener, trusted []*net.IPNet) *proxyProtocolListener {
+	l := &proxyProtocolListener{
+		Listener: listener,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !containsIP(l.trusted, clientIP(conn.RemoteAddr())) {
+			conn.Close()
+			slog.Warn("Rejected connection from outside PROXY_PROTOCOL_TRUSTED_CIDRS", "client", conn.RemoteAddr().String())
+			continue
+		}
+		go func() {
+			defer recoverPanic(slog.Default(), nil)
+			proxied, err := readProxyHeader(conn)
+			if err != nil {
+				conn.Close()
+				slog.Warn("Rejected connection without a valid PROXY header", "client", conn.RemoteAddr().String(), "error", err)
+				return
+			}
+			select {
+			case l.conns <- proxied:
+			case <-l.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyProtocolListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// proxiedConn reports the client address from the PROXY header and reads
+// through the buffer the header was parsed from.
+type proxiedConn struct {
+	bufferedConn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader consumes a v1 or v2 PROXY header from conn. Headers for
+// the LOCAL command or an unknown protocol keep the connection's own address.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var remote net.Addr
+	if bytes.Equal(signature, proxyV2Signature) {
+		remote, err = readProxyV2(reader)
+	} else {
+		remote, err = readProxyV1(reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxiedConn{bufferedConn: bufferedConn{Conn: conn, reader: reader}, remote: remote}, nil
+}
+
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	header, ok := bytes.CutSuffix(line, []byte("\r\n"))
+	if !ok {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+
+	fields := strings.Split(string(header), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errors.New("missing PROXY header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	switch header[12] {
+	case proxyV2CommandLocal:
+		return nil, nil
+	case proxyV2CommandProxy:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command: %#x", header[12])
+	}
+
+	switch header[13] {
+	case proxyV2FamilyTCP4:
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY v2 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case proxyV2FamilyTCP6:
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY v2 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+// proxyV2Header builds the v2 header announcing a connection from client to
+// server. Addresses that are not TCP, or mix families, produce a LOCAL
+// header, which tells the target to use the connection's own address.
+func proxyV2Header(client, server net.Addr) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	src, srcOK := client.(*net.TCPAddr)
+	dst, dstOK := server.(*net.TCPAddr)
+
+	var body []byte
+	family := byte(proxyV2FamilyUnspec)
+	switch {
+	case !srcOK || !dstOK:
+	case src.IP.To4() != nil && dst.IP.To4() != nil:
+		family = proxyV2FamilyTCP4
+		body = append(body, src.IP.To4()...)
+		body = append(body, dst.IP.To4()...)
+	case src.IP.To4() == nil && dst.IP.To4() == nil:
+		family = proxyV2FamilyTCP6
+		body = append(body, src.IP.To16()...)
+		body = append(body, dst.IP.To16()...)
+	}
+
+	command := byte(proxyV2CommandLocal)
+	if family != proxyV2FamilyUnspec {
+		command = proxyV2CommandProxy
+		body = binary.BigEndian.AppendUint16(body, uint16(src.Port))
+		body = binary.BigEndian.AppendUint16(body, uint16(dst.Port))
+	}
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
+
+// listenStream opens the TCP listener for port with the configured PROXY
+// header handling and transport security.
+func (r *relay) listenStream(port int) (net.Listener, error) {
+	return r.security.listen(r.listenAddr(port), r.proxyProtocol.trusted)
+}
+
+// sendProxyHeader writes the PROXY header for conn to upstream when sending
+// headers is enabled.
+func (r *relay) sendProxyHeader(conn, upstream net.Conn) error {
+	if !r.proxyProtocol.send {
+		return nil
+	}
+	_, err := upstream.Write(proxyV2Header(conn.RemoteAddr(), conn.LocalAddr()))
+	return err
+}
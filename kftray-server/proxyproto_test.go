@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a v2 header with the given command, family and body.
+func proxyV2(command, family byte, body []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tcp4 := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0x30, 0x39, 0x01, 0xbb}
+	tcp6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x01, 0xbb)
+
+	tests := []struct {
+		name    string
+		header  []byte
+		remote  string // "" keeps the connection's own address
+		wantErr bool
+	}{
+		{name: "v1 TCP4", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.7 12345 443\r\n"), remote: "192.0.2.1:12345"},
+		{name: "v1 TCP6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), remote: "[2001:db8::1]:12345"},
+		{name: "v1 UNKNOWN", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 UNKNOWN with addresses", header: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")},
+		{name: "v1 longest", header: []byte("PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"), remote: "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535"},
+		{name: "v1 oversized", header: []byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n"), wantErr: true},
+		{name: "v1 truncated", header: []byte("PROXY TCP4 192.0.2.1 198.51"), wantErr: true},
+		{name: "v1 missing CR", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.7 12345 443\n"), wantErr: true},
+		{name: "v1 wrong field count", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.7 12345\r\n"), wantErr: true},
+		{name: "v1 bad address", header: []byte("PROXY TCP4 192.0.2.x 198.51.100.7 12345 443\r\n"), wantErr: true},
+		{name: "v1 bad port", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.7 65536 443\r\n"), wantErr: true},
+		{name: "v1 unknown protocol", header: []byte("PROXY UDP4 192.0.2.1 198.51.100.7 12345 443\r\n"), wantErr: true},
+		{name: "no header", header: []byte("GET / HTTP/1.1\r\n\r\n"), wantErr: true},
+		{name: "v2 TCP4", header: proxyV2(proxyV2CommandProxy, proxyV2FamilyTCP4, tcp4), remote: "192.0.2.1:12345"},
+		{name: "v2 TCP6", header: proxyV2(proxyV2CommandProxy, proxyV2FamilyTCP6, tcp6), remote: "[2001:db8::1]:12345"},
+		{name: "v2 TCP4 with TLVs", header: proxyV2(proxyV2CommandProxy, proxyV2FamilyTCP4, append(tcp4, 0x04, 0x00, 0x01, 0xff)), remote: "192.0.2.1:12345"},
+		{name: "v2 LOCAL", header: proxyV2(proxyV2CommandLocal, proxyV2FamilyUnspec, nil)},
+		{name: "v2 LOCAL ignores addresses", header: proxyV2(proxyV2CommandLocal, proxyV2FamilyTCP4, tcp4)},
+		{name: "v2 UNSPEC", header: proxyV2(proxyV2CommandProxy, proxyV2FamilyUnspec, nil)},
+		{name: "v2 unknown command", header: proxyV2(0x22, proxyV2FamilyTCP4, tcp4), wantErr: true},
+		{name: "v2 wrong version", header: proxyV2(0x11, proxyV2FamilyTCP4, tcp4), wantErr: true},
+		{name: "v2 short TCP4 block", header: proxyV2(proxyV2CommandProxy, proxyV2FamilyTCP4, tcp4[:11]), wantErr: true},
+		{name: "v2 short TCP6 block", header: proxyV2(proxyV2CommandProxy, proxyV2FamilyTCP6, tcp6[:35]), wantErr: true},
+		{name: "v2 truncated fixed header", header: proxyV2(proxyV2CommandProxy, proxyV2FamilyTCP4, tcp4)[:14], wantErr: true},
+		{name: "v2 truncated body", header: proxyV2(proxyV2CommandProxy, proxyV2FamilyTCP4, tcp4)[:20], wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			payload := []byte("payload")
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(tt.header)
+				if !tt.wantErr {
+					client.Write(payload)
+				}
+				client.Close()
+			}()
+
+			conn, err := readProxyHeader(server)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readProxyHeader() accepted %q, remote %v", tt.header, conn.RemoteAddr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader() = %v", err)
+			}
+
+			want := tt.remote
+			if want == "" {
+				want = server.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != want {
+				t.Errorf("RemoteAddr() = %s, want %s", got, want)
+			}
+			rest, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rest, payload) {
+				t.Errorf("data after header = %q, want %q", rest, payload)
+			}
+		})
+	}
+}
+
+func TestProxyV2HeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name           string
+		client, server net.Addr
+		remote         string // "" for a LOCAL header
+	}{
+		{
+			name:   "TCP4",
+			client: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345},
+			server: &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 443},
+			remote: "192.0.2.1:12345",
+		},
+		{
+			name:   "TCP6",
+			client: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 12345},
+			server: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			remote: "[2001:db8::1]:12345",
+		},
+		{
+			name:   "mixed families",
+			client: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345},
+			server: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+		{
+			name:   "not TCP",
+			client: &net.UnixAddr{Name: "/run/client.sock", Net: "unix"},
+			server: &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 443},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := proxyV2Header(tt.client, tt.server)
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(header)
+				client.Close()
+			}()
+
+			conn, err := readProxyHeader(server)
+			if err != nil {
+				t.Fatalf("readProxyHeader() = %v", err)
+			}
+			want := tt.remote
+			if want == "" {
+				if header[12] != proxyV2CommandLocal {
+					t.Errorf("command = %#x, want LOCAL", header[12])
+				}
+				want = server.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != want {
+				t.Errorf("RemoteAddr() = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadProxyProtocol(t *testing.T) {
+	tests := []struct {
+		mode, trusted string
+		wantErr       bool
+	}{
+		{mode: ""},
+		{mode: "send"},
+		{mode: "accept", trusted: "10.0.0.0/8, 192.0.2.0/24"},
+		{mode: "accept,send", trusted: "0.0.0.0/0"},
+		{mode: "accept", wantErr: true},
+		{mode: "send", trusted: "10.0.0.0/8", wantErr: true},
+		{mode: "accept", trusted: "10.0.0.1", wantErr: true},
+		{mode: "forward", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+tt.trusted, func(t *testing.T) {
+			t.Setenv("PROXY_PROTOCOL", tt.mode)
+			t.Setenv("PROXY_PROTOCOL_TRUSTED_CIDRS", tt.trusted)
+			_, err := loadProxyProtocol()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadProxyProtocol() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestProxyProtocolTrustedSenders checks that a PROXY header is only
+// believed from a trusted network, and that other senders are dropped
+// before their header can stand in for their address.
+func TestProxyProtocolTrustedSenders(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		want    string // "" when the connection must be rejected
+	}{
+		{name: "trusted", trusted: "127.0.0.0/8", want: "192.0.2.1:12345"},
+		{name: "untrusted", trusted: "10.0.0.0/8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, trusted, err := net.ParseCIDR(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener, err := listenTCP("127.0.0.1:0", nil, []*net.IPNet{trusted})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.7 12345 443\r\n"))
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err == nil {
+					accepted <- conn
+				}
+			}()
+			if tt.want == "" {
+				client.SetReadDeadline(time.Now().Add(2 * time.Second))
+				if _, err := client.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+					t.Errorf("read = %v, want the connection closed", err)
+				}
+				select {
+				case conn := <-accepted:
+					conn.Close()
+					t.Errorf("accepted connection from %v", conn.RemoteAddr())
+				default:
+				}
+				return
+			}
+			select {
+			case conn := <-accepted:
+				defer conn.Close()
+				if got := conn.RemoteAddr().String(); got != tt.want {
+					t.Errorf("RemoteAddr() = %s, want %s", got, tt.want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("connection was not accepted")
+			}
+		})
+	}
+}
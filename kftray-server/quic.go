@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicALPN is the application protocol negotiated by kftray QUIC clients.
+const quicALPN = "kftray-relay"
+
+// startQUICProxy accepts QUIC connections and relays every bidirectional
+// stream on them to the TCP target, so one connection can carry many
+// logical tunnels. QUIC always runs over TLS 1.3; without TLS_CERT/TLS_KEY an
+// ephemeral self-signed certificate is used. This transport is experimental.
+//
+// All connections share the tunnel's UDP socket, so when the tunnel stops it
+// stops accepting connections and streams but keeps the socket open until
+// the streams already accepted have ended.
+func (r *relay) startQUICProxy(tunnel tunnelConfig) error {
+	logger := slog.With("tunnel", tunnel.Name)
+
+	tlsConfig, err := r.quicTLSConfig(logger)
+	if err != nil {
+		return fmt.Errorf("failed to configure QUIC TLS: %w", err)
+	}
+
+	packetConn, err := listenConfig.ListenPacket(context.Background(), "udp", r.listenAddr(tunnel.LocalPort))
+	if err != nil {
+		return fmt.Errorf("failed to start QUIC listener: %w", err)
+	}
+	defer packetConn.Close()
+	// Unlike quic.Listen, a listener from a Transport can be closed without
+	// closing the connections it accepted.
+	transport := &quic.Transport{Conn: packetConn}
+	defer transport.Close()
+	listener, err := transport.Listen(tlsConfig, &quic.Config{
+		MaxIdleTimeout:  time.Minute,
+		KeepAlivePeriod: 15 * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start QUIC listener: %w", err)
+	}
+	r.closeOnShutdown(listener)
+	r.ready.markReady(tunnel.Name)
+
+	targets := r.targetsFor(tunnel, logger)
+	logger.Info("QUIC proxy listening", "port", tunnel.LocalPort, "target", tunnel.targetDescription())
+
+	metrics := newTunnelMetrics(tunnel.Name)
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	for {
+		conn, err := listener.Accept(r.ctx)
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return nil
+			}
+			metrics.error("accept")
+			logger.Error("Failed to accept QUIC connection", "error", err)
+			continue
+		}
+
+		release, err := r.admission.admit(conn.RemoteAddr())
+		if err != nil {
+			metrics.error(rejectionKind(err))
+			logger.Warn("Rejected connection", "client", conn.RemoteAddr().String(), "error", err)
+			conn.CloseWithError(0, err.Error())
+			continue
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer release()
+			defer recoverPanic(logger, metrics)
+			r.handleQUICConnection(conn, targets, logger, metrics)
+		}()
+	}
+}
+
+// handleQUICConnection relays the streams of conn until the client closes it
+// or the tunnel stops. A stopped tunnel accepts no new streams and closes the
+// connection once the streams it already accepted have ended.
+func (r *relay) handleQUICConnection(conn quic.Connection, targets *targetPool, logger *slog.Logger, metrics *tunnelMetrics) {
+	connLogger := logger.With("client", conn.RemoteAddr().String())
+	connLogger.Info("Accepted QUIC connection")
+
+	var streams sync.WaitGroup
+	for {
+		stream, err := conn.AcceptStream(r.ctx)
+		if err != nil {
+			if r.ctx.Err() != nil {
+				streams.Wait()
+				conn.CloseWithError(0, "shutting down")
+			}
+			connLogger.Info("QUIC connection closed", "reason", err)
+			return
+		}
+		r.sessions.start()
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			defer r.sessions.done()
+			logger := withSession(logger)
+			defer recoverPanic(logger, metrics)
+			logger.Info("Accepted QUIC stream", "client", conn.RemoteAddr().String(), "stream", stream.StreamID())
+			r.relayTCP(&quicStreamConn{Stream: stream, conn: conn}, targets, logger, metrics)
+		}()
+	}
+}
+
+func (r *relay) quicTLSConfig(logger *slog.Logger) (*tls.Config, error) {
+	var config *tls.Config
+	if r.security.tlsConfig != nil {
+		config = r.security.tlsConfig.Clone()
+	} else {
+		cert, err := generateSelfSignedCert()
+		if err != nil {
+			return nil, err
+		}
+		fingerprint := sha256.Sum256(cert.Certificate[0])
+		logger.Info("Generated self-signed QUIC certificate", "sha256_fingerprint", hex.EncodeToString(fingerprint[:]))
+		config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	config.MinVersion = tls.VersionTLS13
+	config.NextProtos = []string{quicALPN}
+	return config, nil
+}
+
+// quicStreamConn adapts a QUIC stream to net.Conn using the addresses of the
+// connection that carries it.
+type quicStreamConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicStreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// CloseWrite ends the send side of the stream only.
+func (c *quicStreamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// Close shuts down both directions; quic.Stream.Close only ends the send side.
+func (c *quicStreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// TestQUICRelay relays streams through a quic tunnel and checks that several
+// streams can share one connection and that clients negotiating another
+// application protocol are refused.
+func TestQUICRelay(t *testing.T) {
+	addr := startEchoTunnel(t, newTestRelay(t), "quic")
+
+	tests := []struct {
+		name    string
+		alpn    string
+		streams int
+		wantErr bool
+	}{
+		{name: "one stream", alpn: quicALPN, streams: 1},
+		{name: "concurrent streams", alpn: quicALPN, streams: 4},
+		{name: "wrong ALPN", alpn: "h3", wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := quic.DialAddr(ctx, addr, &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{tt.alpn},
+			}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dial error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.CloseWithError(0, "")
+
+			var wg sync.WaitGroup
+			errs := make(chan error, tt.streams)
+			for i := 0; i < tt.streams; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					stream, err := conn.OpenStreamSync(ctx)
+					if err != nil {
+						errs <- err
+						return
+					}
+					streamConn := &quicStreamConn{Stream: stream, conn: conn}
+					defer streamConn.Close()
+					errs <- echoOver(streamConn)
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Errorf("relay via stream: %v", err)
+				}
+			}
+		})
+	}
+}
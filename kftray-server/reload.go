@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// portReleaseWait bounds how long applying a configuration waits for a
+// stopped tunnel to release a port a new tunnel needs. When it is still held,
+// starting that tunnel is retried every portRetryInterval instead, so one
+// long-lived session cannot hold up later reloads.
+const (
+	portReleaseWait   = time.Second
+	portRetryInterval = 5 * time.Second
+)
+
+// tunnelManager runs the configured tunnels and applies configuration
+// reloads, restarting only the tunnels whose configuration changed.
+type tunnelManager struct {
+	relay   *relay
+	running map[string]*runningTunnel
+
+	// stopping holds the stopped tunnels that may still hold their local
+	// port, keyed by it.
+	stopping map[int]*runningTunnel
+
+	// wanted is the configuration last applied, and waiting reports whether
+	// some of its tunnels are waiting for their port to be released.
+	wanted  []tunnelConfig
+	waiting bool
+}
+
+type runningTunnel struct {
+	config tunnelConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newTunnelManager(r *relay) *tunnelManager {
+	return &tunnelManager{relay: r, running: make(map[string]*runningTunnel), stopping: make(map[int]*runningTunnel)}
+}
+
+// apply stops the running tunnels that were removed or changed, then starts
+// the new and changed ones. Stopping a tunnel closes its listener; sessions
+// it already accepted keep running until they end. Unchanged tunnels are
+// left alone. A tunnel whose port is still held by a stopped one, as a quic
+// tunnel holds it until its streams have ended, is left waiting for a later
+// retry. The tunnels that failed to start listening are returned as an
+// error; the others keep running.
+func (m *tunnelManager) apply(tunnels []tunnelConfig) error {
+	m.wanted = tunnels
+	m.waiting = false
+	wanted := make(map[string]tunnelConfig, len(tunnels))
+	for _, tunnel := range tunnels {
+		wanted[tunnel.Name] = tunnel
+	}
+
+	for name, running := range m.running {
+		if tunnel, ok := wanted[name]; ok && tunnel == running.config {
+			continue
+		}
+		running.cancel()
+		delete(m.running, name)
+		m.relay.ready.remove(name)
+		if running.config.LocalPort != 0 {
+			m.stopping[running.config.LocalPort] = running
+		}
+		go func(name string, done <-chan struct{}) {
+			<-done
+			slog.Info("Stopped tunnel", "tunnel", name)
+		}(name, running.done)
+	}
+
+	var errs []error
+	for _, tunnel := range tunnels {
+		if _, ok := m.running[tunnel.Name]; ok {
+			continue
+		}
+		if !m.portReleased(tunnel.LocalPort) {
+			m.waiting = true
+			slog.Warn("Port still held by a stopped tunnel", "tunnel", tunnel.Name, "port", tunnel.LocalPort, "retry_in", portRetryInterval.String())
+			continue
+		}
+		if err := m.start(tunnel); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel %q: %w", tunnel.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// portReleased waits up to portReleaseWait for a stopped tunnel that
+// listened on port to end, and reports whether it has.
+func (m *tunnelManager) portReleased(port int) bool {
+	stopping, ok := m.stopping[port]
+	if !ok {
+		return true
+	}
+	select {
+	case <-stopping.done:
+		delete(m.stopping, port)
+		return true
+	case <-time.After(portReleaseWait):
+		return false
+	}
+}
+
+// start runs the tunnel on a copy of the relay whose context ends when the
+// tunnel is stopped, so only its own listener is closed. It returns once the
+// tunnel is listening, or with the error that kept it from listening.
+// Reverse tunnels have no listener and are not waited for.
+func (m *tunnelManager) start(tunnel tunnelConfig) error {
+	ctx, cancel := context.WithCancel(m.relay.ctx)
+	tunnelRelay := *m.relay
+	tunnelRelay.ctx = ctx
+
+	running := &runningTunnel{config: tunnel, cancel: cancel, done: make(chan struct{})}
+	ready := m.relay.ready.add(tunnel.Name)
+	failed := make(chan error, 1)
+	go func() {
+		defer close(running.done)
+		if err := tunnelRelay.runTunnel(tunnel); err != nil {
+			failed <- err
+		}
+	}()
+
+	if tunnel.LocalPort != 0 {
+		select {
+		case <-ready:
+		case err := <-failed:
+			cancel()
+			m.relay.ready.remove(tunnel.Name)
+			return err
+		}
+	}
+	m.running[tunnel.Name] = running
+	return nil
+}
+
+// watch reloads the config file on SIGHUP and, when CONFIG_RELOAD_INTERVAL is
+// set, whenever its contents change, until the relay shuts down. An invalid
+// new configuration is logged and the running tunnels are kept. A new
+// tunnel that cannot listen is logged and left stopped, and tunnels waiting
+// for their port are retried every portRetryInterval.
+func (m *tunnelManager) watch(pollInterval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	path := setting(configFlag, "CONFIG_FILE")
+	var poll <-chan time.Time
+	if path != "" && pollInterval > 0 {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	lastContents, _ := os.ReadFile(path)
+
+	for {
+		var retry <-chan time.Time
+		if m.waiting {
+			retry = time.After(portRetryInterval)
+		}
+		select {
+		case <-m.relay.ctx.Done():
+			return
+		case <-retry:
+			m.logFailed(m.apply(m.wanted))
+			continue
+		case <-hup:
+			if path == "" {
+				slog.Warn("Ignoring SIGHUP: tunnels are not loaded from a config file")
+				continue
+			}
+			slog.Info("Reloading configuration", "reason", "SIGHUP")
+		case <-poll:
+			contents, err := os.ReadFile(path)
+			if err != nil || bytes.Equal(contents, lastContents) {
+				continue
+			}
+			slog.Info("Reloading configuration", "reason", "config file changed")
+		}
+
+		lastContents, _ = os.ReadFile(path)
+		if err := m.reload(); err != nil {
+			slog.Error("Failed to reload configuration; keeping running tunnels", "error", err)
+		}
+	}
+}
+
+func (m *tunnelManager) reload() error {
+	tunnels, err := loadTunnels()
+	if err != nil {
+		return err
+	}
+	if err := m.relay.checkSupported(tunnels); err != nil {
+		return err
+	}
+	if _, err := loadAdminPort(tunnels); err != nil {
+		return err
+	}
+	m.logFailed(m.apply(tunnels))
+	slog.Info("Configuration reloaded", "tunnels", len(tunnels))
+	return nil
+}
+
+// logFailed logs each tunnel that apply could not start.
+func (m *tunnelManager) logFailed(err error) {
+	for _, err := range splitErrors(err) {
+		slog.Error("Failed to start tunnel; the other tunnels keep running", "error", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestApplyBindFailure applies a configuration in which one tunnel's port is
+// taken, and checks that the failure is returned while the other tunnel
+// starts and keeps relaying.
+func TestApplyBindFailure(t *testing.T) {
+	echo := startEcho(t, "tcp", "127.0.0.1:0")
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRelay(t)
+	r.listenHost = "127.0.0.1"
+	manager := newTunnelManager(r)
+	err = manager.apply([]tunnelConfig{
+		{Name: "free", LocalPort: port, RemoteAddress: "127.0.0.1", RemotePort: echo.Addr().(*net.TCPAddr).Port, ProxyType: "tcp"},
+		{Name: "taken", LocalPort: taken.Addr().(*net.TCPAddr).Port, RemoteAddress: "127.0.0.1", RemotePort: echo.Addr().(*net.TCPAddr).Port, ProxyType: "tcp"},
+	})
+	if err == nil || !strings.Contains(err.Error(), `"taken"`) {
+		t.Fatalf("apply() = %v, want an error for tunnel taken", err)
+	}
+	if _, ok := manager.running["taken"]; ok {
+		t.Error("tunnel taken is listed as running")
+	}
+	if notReady := r.ready.notReady(); len(notReady) > 0 {
+		t.Errorf("not ready: %v", notReady)
+	}
+	if err := echoRoundTrip(net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err != nil {
+		t.Errorf("relay via tunnel free: %v", err)
+	}
+}
+
+// TestApplyPortStillHeld applies a tunnel whose port is still held by a
+// stopped tunnel, and checks that apply does not block on it and that the
+// tunnel starts on a later apply once the port is released.
+func TestApplyPortStillHeld(t *testing.T) {
+	echo := startEcho(t, "tcp", "127.0.0.1:0")
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRelay(t)
+	r.listenHost = "127.0.0.1"
+	manager := newTunnelManager(r)
+	stopped := &runningTunnel{done: make(chan struct{})}
+	manager.stopping[port] = stopped
+
+	tunnels := []tunnelConfig{
+		{Name: "reused", LocalPort: port, RemoteAddress: "127.0.0.1", RemotePort: echo.Addr().(*net.TCPAddr).Port, ProxyType: "tcp"},
+	}
+	start := time.Now()
+	if err := manager.apply(tunnels); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*portReleaseWait {
+		t.Errorf("apply() took %v, want at most about %v", elapsed, portReleaseWait)
+	}
+	if !manager.waiting {
+		t.Error("apply() did not leave the tunnel waiting for its port")
+	}
+	if _, ok := manager.running["reused"]; ok {
+		t.Fatal("tunnel started while its port was held")
+	}
+
+	close(stopped.done)
+	if err := manager.apply(manager.wanted); err != nil {
+		t.Fatal(err)
+	}
+	if manager.waiting {
+		t.Error("tunnel still waiting after the port was released")
+	}
+	if err := echoRoundTrip(net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err != nil {
+		t.Errorf("relay via tunnel reused: %v", err)
+	}
+}
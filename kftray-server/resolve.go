@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultDNSRefreshInterval = 30 * time.Second
+
+// targetResolver caches the UDP address of a tunnel's target and resolves it
+// again once the cached result is older than the refresh interval, or after
+// invalidate, so new sessions follow DNS changes such as failovers and
+// headless service updates. TCP targets need no cache: every connection is
+// dialed by name.
+type targetResolver struct {
+	target   string
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu         sync.Mutex
+	addr       *net.UDPAddr
+	resolvedAt time.Time
+}
+
+func newTargetResolver(target string, interval time.Duration, logger *slog.Logger) *targetResolver {
+	return &targetResolver{target: target, interval: interval, logger: logger}
+}
+
+// resolve returns the target address, resolving it again when the cached one
+// is stale. If resolution fails but an earlier address is known, that address
+// is returned so a DNS outage does not stop the tunnel.
+func (t *targetResolver) resolve() (*net.UDPAddr, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.addr != nil && time.Since(t.resolvedAt) < t.interval {
+		return t.addr, nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", t.target)
+	if err != nil {
+		if t.addr == nil {
+			return nil, err
+		}
+		t.logger.Warn("Failed to re-resolve target; using previous address", "target", t.target, "address", t.addr.String(), "error", err)
+		t.resolvedAt = time.Now()
+		return t.addr, nil
+	}
+	if t.addr != nil && !addr.IP.Equal(t.addr.IP) {
+		t.logger.Info("Target address changed", "target", t.target, "previous", t.addr.String(), "address", addr.String())
+	}
+	t.addr = addr
+	t.resolvedAt = time.Now()
+	return addr, nil
+}
+
+// invalidate makes the next resolve look the target up again, after a
+// session to the cached address failed.
+func (t *targetResolver) invalidate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resolvedAt = time.Time{}
+}
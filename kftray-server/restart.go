@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	handoffRequest = "handoff"
+	handoffReply   = "ok"
+	handoffTimeout = 5 * time.Second
+)
+
+// listenConfig creates every relay listener. With hot restart enabled it
+// sets SO_REUSEPORT, so the ports stay bound while one process hands over to
+// the next.
+var listenConfig net.ListenConfig
+
+// loadHotRestart returns the control socket path from HOT_RESTART_SOCKET, or
+// "" when hot restarts are disabled, and enables SO_REUSEPORT on listeners
+// when it is set.
+func loadHotRestart() (string, error) {
+	path := os.Getenv("HOT_RESTART_SOCKET")
+	if path == "" {
+		return "", nil
+	}
+	if !reusePortSupported {
+		return "", fmt.Errorf("HOT_RESTART_SOCKET is not supported on %s", runtime.GOOS)
+	}
+	listenConfig.Control = reusePortControl
+	return path, nil
+}
+
+// serveHotRestart takes over from the process listening on the control
+// socket at path, if any, once every tunnel of this process is listening,
+// and then listens on the socket itself. A later process that connects and
+// requests a handoff makes this one stop accepting through handOff, as on
+// SIGTERM, while the new process serves new connections on the same ports.
+// The sessions this process already relays are not moved; they keep running
+// until they close, see drainHandedOff.
+func (r *relay) serveHotRestart(path string, handOff func()) {
+	if !r.waitForTunnels() {
+		return
+	}
+	if err := requestHandoff(path); err != nil {
+		slog.Warn("Hot restart handoff failed", "socket", path, "error", err)
+	}
+
+	os.Remove(path)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		slog.Error("Failed to listen on hot restart socket", "socket", path, "error", err)
+		return
+	}
+	// The next process replaces the socket file before this one closes its
+	// listener, so it is only removed here when no handoff happened.
+	listener.SetUnlinkOnClose(false)
+	var handedOff atomic.Bool
+	go func() {
+		<-r.ctx.Done()
+		listener.Close()
+		if !handedOff.Load() {
+			os.Remove(path)
+		}
+	}()
+	slog.Info("Hot restart socket listening", "socket", path)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if r.shuttingDown(err) {
+				return
+			}
+			slog.Error("Failed to accept on hot restart socket", "error", err)
+			continue
+		}
+		if answerHandoff(conn) {
+			handedOff.Store(true)
+			slog.Info("Handed off to new process, draining sessions")
+			handOff()
+			return
+		}
+	}
+}
+
+// drainHandedOff waits for the sessions left after a handoff to close, with
+// no time limit, so a hot restart does not cut long-lived tunnels after
+// SHUTDOWN_TIMEOUT. SIGTERM or an interrupt during the wait stops the
+// process like a normal shutdown, waiting at most timeout. It reports
+// whether all sessions finished.
+func (r *relay) drainHandedOff(timeout time.Duration) bool {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	slog.Info("Draining sessions until they close", "active_sessions", r.sessions.active.Load())
+	select {
+	case <-r.sessions.finished():
+		return true
+	case <-signals:
+	}
+	slog.Info("Shutting down", "timeout", timeout.String(), "active_sessions", r.sessions.active.Load())
+	return r.sessions.wait(timeout)
+}
+
+// requestHandoff asks the process listening on path to stop accepting. It
+// succeeds without doing anything when no process is listening.
+func requestHandoff(path string) error {
+	conn, err := net.DialTimeout("unix", path, handoffTimeout)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil
+		}
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handoffTimeout))
+
+	if _, err := fmt.Fprintln(conn, handoffRequest); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read handoff reply: %w", err)
+	}
+	if strings.TrimSpace(reply) != handoffReply {
+		return fmt.Errorf("unexpected handoff reply: %q", strings.TrimSpace(reply))
+	}
+	slog.Info("Took over from previous process", "socket", path)
+	return nil
+}
+
+// answerHandoff reads one request from conn and reports whether it was a
+// valid handoff request, which it acknowledges.
+func answerHandoff(conn net.Conn) bool {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handoffTimeout))
+
+	request, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || strings.TrimSpace(request) != handoffRequest {
+		slog.Warn("Ignoring invalid hot restart request", "error", err)
+		return false
+	}
+	_, err = fmt.Fprintln(conn, handoffReply)
+	return err == nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDrainHandedOff checks that a process that handed off keeps waiting for
+// its sessions past the shutdown timeout, and returns once they close.
+func TestDrainHandedOff(t *testing.T) {
+	r := newTestRelay(t)
+	r.sessions.start()
+
+	drained := make(chan bool, 1)
+	go func() { drained <- r.drainHandedOff(10 * time.Millisecond) }()
+	select {
+	case <-drained:
+		t.Fatal("drain returned while a session was still running")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	r.sessions.done()
+	select {
+	case ok := <-drained:
+		if !ok {
+			t.Error("drainHandedOff() = false, want true")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return after the session closed")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "syscall"
+
+// reusePortControl is never installed where SO_REUSEPORT is unavailable;
+// loadHotRestart rejects HOT_RESTART_SOCKET instead.
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return nil
+}
+
+const reusePortSupported = false
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// reversePoolSize is how many idle outbound connections each reverse
+	// tunnel keeps open to the broker, ready to be claimed by clients.
+	reversePoolSize = 4
+
+	// reverseOpen is sent by the broker on an idle connection when it has
+	// paired it with a client; the server then dials the target.
+	reverseOpen = 0x01
+
+	reverseMinBackoff = time.Second
+	reverseMaxBackoff = 30 * time.Second
+)
+
+// startReverseTunnel serves a tunnel by dialing out to the broker at
+// connect_address instead of listening, for clusters that allow egress but
+// no inbound port-forward. Each pooled connection is secured with broker TLS
+// and AUTH_PSK when configured, waits for the broker's open signal and then
+// relays to the target like a tcp tunnel.
+func (r *relay) startReverseTunnel(tunnel tunnelConfig) error {
+	logger := slog.With("tunnel", tunnel.Name)
+	targets := r.targetsFor(tunnel, logger)
+	logger.Info("Reverse tunnel dialing out", "connect_address", tunnel.ConnectAddress, "target", tunnel.targetDescription(), "pool_size", reversePoolSize)
+
+	metrics := newTunnelMetrics(tunnel.Name)
+	var wg sync.WaitGroup
+	for i := 0; i < reversePoolSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer recoverPanic(logger, metrics)
+			r.runReverseSlot(tunnel, targets, logger, metrics)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// runReverseSlot keeps one pooled broker connection open until shutdown,
+// redialing with exponential backoff when the broker is unreachable or drops
+// an idle connection.
+func (r *relay) runReverseSlot(tunnel tunnelConfig, targets *targetPool, logger *slog.Logger, metrics *tunnelMetrics) {
+	backoff := reverseMinBackoff
+	dialer := net.Dialer{Timeout: timeoutSettings.dial}
+	for r.ctx.Err() == nil {
+		conn, err := dialer.DialContext(r.ctx, "tcp", tunnel.ConnectAddress)
+		if err == nil {
+			tuneConn(conn)
+			conn, err = r.secureBrokerConn(conn, tunnel.ConnectAddress)
+			if err != nil {
+				metrics.error("auth")
+				logger.Warn("Failed to authenticate broker", "connect_address", tunnel.ConnectAddress, "error", err, "retry_in", backoff.String())
+			} else {
+				r.ready.markReady(tunnel.Name)
+				if r.serveReverseConn(conn, targets, logger, metrics) {
+					backoff = reverseMinBackoff
+					continue
+				}
+			}
+		} else if r.ctx.Err() == nil {
+			metrics.error("dial")
+			logger.Warn("Failed to connect to broker", "connect_address", tunnel.ConnectAddress, "error", err, "retry_in", backoff.String())
+		}
+
+		select {
+		case <-r.ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, reverseMaxBackoff)
+	}
+}
+
+// secureBrokerConn wraps conn in TLS when broker TLS is configured,
+// verifying the broker's certificate against the host of address, and then
+// has the broker answer the pre-shared key challenge when AUTH_PSK is set.
+// conn is closed when either fails.
+func (r *relay) secureBrokerConn(conn net.Conn, address string) (net.Conn, error) {
+	if config := r.security.brokerTLS; config != nil {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(address)
+		conn = tls.Client(conn, config)
+	}
+	if err := r.security.authenticate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// serveReverseConn waits on an idle broker connection for the open signal
+// and then relays it to the target in its own goroutine, so the slot can
+// dial a replacement and a stopped tunnel does not wait for its claimed
+// sessions. It reports whether the connection was claimed, so idle
+// connections the broker drops are redialed with backoff.
+func (r *relay) serveReverseConn(conn net.Conn, targets *targetPool, logger *slog.Logger, metrics *tunnelMetrics) bool {
+	// Idle connections are closed on shutdown; claimed ones drain like any
+	// other session.
+	stop := context.AfterFunc(r.ctx, func() { conn.Close() })
+	var signal [1]byte
+	_, err := io.ReadFull(conn, signal[:])
+	if !stop() {
+		conn.Close()
+		return false
+	}
+	if err != nil {
+		conn.Close()
+		if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+			metrics.error("read")
+			logger.Warn("Idle broker connection failed", "error", err)
+		}
+		return false
+	}
+	if signal[0] != reverseOpen {
+		conn.Close()
+		metrics.error("frame")
+		logger.Error("Unexpected signal from broker", "signal", signal[0])
+		return false
+	}
+
+	r.sessions.start()
+	go func() {
+		defer r.sessions.done()
+		r.relayReverse(conn, targets, withSession(logger), metrics)
+	}()
+	return true
+}
+
+// relayReverse relays a claimed broker connection to the target.
+func (r *relay) relayReverse(conn net.Conn, targets *targetPool, logger *slog.Logger, metrics *tunnelMetrics) {
+	defer recoverPanic(logger, metrics)
+	defer conn.Close()
+	logger.Info("Accepted connection from broker", "broker", conn.RemoteAddr().String())
+
+	metrics.connOpened()
+	defer metrics.connClosed()
+
+	upstream, targetAddr, err := targets.dial()
+	if err != nil {
+		metrics.error("dial")
+		logger.Error("Failed to connect to target", "target", targetAddr, "error", err)
+		return
+	}
+	logger.Info("Established TCP connection", "target", targetAddr)
+	r.pipe(conn, upstream, logger, metrics)
+}
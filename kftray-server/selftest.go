@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	selfTestHost    = "127.0.0.1"
+	selfTestTimeout = 10 * time.Second
+)
+
+var selfTestPayload = []byte("kftray-server self-test")
+
+// runSelfTest starts loopback TCP and UDP echo targets, relays traffic to
+// them through a tcp and a udp tunnel on free loopback ports, and checks
+// that every payload comes back unchanged.
+func runSelfTest() error {
+	if err := setupBuffers(); err != nil {
+		return err
+	}
+	if err := setupFraming(); err != nil {
+		return err
+	}
+	if err := setupSocketOptions(); err != nil {
+		return err
+	}
+	if err := setupTimeouts(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tcpTarget, err := startTCPEcho(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start TCP echo target: %w", err)
+	}
+	udpTarget, err := startUDPEcho(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start UDP echo target: %w", err)
+	}
+
+	tcpPort, err := freePort()
+	if err != nil {
+		return err
+	}
+	udpPort, err := freePort()
+	if err != nil {
+		return err
+	}
+	tunnels := []tunnelConfig{
+		{Name: "self-test-tcp", ProxyType: "tcp", LocalPort: tcpPort, RemoteAddress: selfTestHost, RemotePort: tcpTarget},
+		{Name: "self-test-udp", ProxyType: "udp", LocalPort: udpPort, RemoteAddress: selfTestHost, RemotePort: udpTarget},
+	}
+
+	r := &relay{
+		ctx:                 ctx,
+		listenHost:          selfTestHost,
+		ready:               newReadiness(),
+		sessions:            new(sessionTracker),
+		admission:           &admissionControl{clients: make(map[string]*clientLimiter)},
+		udpIdleTimeout:      defaultUDPIdleTimeout,
+		dnsRefreshInterval:  defaultDNSRefreshInterval,
+		healthCheckInterval: defaultHealthCheckInterval,
+	}
+	if err := newTunnelManager(r).apply(tunnels); err != nil {
+		return err
+	}
+	if err := waitReady(r.ready); err != nil {
+		return err
+	}
+
+	if err := checkTCPTunnel(r.listenAddr(tcpPort)); err != nil {
+		return fmt.Errorf("tcp tunnel: %w", err)
+	}
+	slog.Info("Self-test passed", "proxy_type", "tcp")
+	if err := checkUDPTunnel(r.listenAddr(udpPort)); err != nil {
+		return fmt.Errorf("udp tunnel: %w", err)
+	}
+	slog.Info("Self-test passed", "proxy_type", "udp")
+	return nil
+}
+
+// freePort returns a loopback TCP port that was free a moment ago.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(selfTestHost, "0"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+func waitReady(ready *readiness) error {
+	deadline := time.Now().Add(selfTestTimeout)
+	for len(ready.notReady()) > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tunnels not ready: %v", ready.notReady())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// startTCPEcho serves a TCP echo on a loopback port until ctx ends and
+// returns the port.
+func startTCPEcho(ctx context.Context) (int, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(selfTestHost, "0"))
+	if err != nil {
+		return 0, err
+	}
+	context.AfterFunc(ctx, func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// startUDPEcho serves a UDP echo on a loopback port until ctx ends and
+// returns the port.
+func startUDPEcho(ctx context.Context) (int, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(selfTestHost)})
+	if err != nil {
+		return 0, err
+	}
+	context.AfterFunc(ctx, func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+func checkTCPTunnel(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, selfTestTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(selfTestTimeout))
+
+	if _, err := conn.Write(selfTestPayload); err != nil {
+		return err
+	}
+	reply := make([]byte, len(selfTestPayload))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	return comparePayload(reply)
+}
+
+// checkUDPTunnel sends a length-prefixed datagram through a udp tunnel and
+// reads the framed echo back.
+func checkUDPTunnel(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, selfTestTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(selfTestTimeout))
+
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(selfTestPayload)))
+	frame = append(frame, selfTestPayload...)
+	if frameSettings.checksum {
+		frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum(selfTestPayload, crcTable))
+	}
+	if _, err := conn.Write(frame); err != nil {
+		return err
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length != uint32(len(selfTestPayload)) {
+		return fmt.Errorf("unexpected frame length %d", length)
+	}
+	reply, err := readPayload(conn, make([]byte, length), length)
+	if err != nil {
+		return err
+	}
+	return comparePayload(reply)
+}
+
+func comparePayload(reply []byte) error {
+	if !bytes.Equal(reply, selfTestPayload) {
+		return errors.New("echoed payload does not match what was sent")
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "context"
+
+// startService is a no-op outside Windows, where service managers stop the
+// relay with SIGTERM.
+func startService(context.CancelFunc) (stopped func()) {
+	return func() {}
+}
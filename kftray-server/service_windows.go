@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// startService runs the relay under the Windows service control manager
+// when it was started as a service: a stop or shutdown request calls stop,
+// and the service is reported stopped once the returned function is called
+// after sessions have drained.
+func startService(stop context.CancelFunc) (stopped func()) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return func() {}
+	}
+
+	handler := &serviceHandler{stop: stop, drained: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := svc.Run("kftray-server", handler); err != nil {
+			fatal("Windows service failed", "error", err)
+		}
+	}()
+	return func() {
+		close(handler.drained)
+		<-done
+	}
+}
+
+type serviceHandler struct {
+	stop    context.CancelFunc
+	drained chan struct{}
+}
+
+func (h *serviceHandler) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			status <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			slog.Info("Stop requested by the service control manager")
+			status <- svc.Status{State: svc.StopPending}
+			h.stop()
+			<-h.drained
+			return false, 0
+		}
+	}
+	return false, 0
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultUDPIdleTimeout = 2 * time.Minute
+
+// sessionTracker counts the connections currently being relayed so shutdown
+// can wait for them to finish, and keeps per-session statistics for the
+// admin sessions endpoint.
+type sessionTracker struct {
+	wg     sync.WaitGroup
+	active atomic.Int64
+
+	mu   sync.Mutex
+	open map[*sessionStats]struct{}
+}
+
+// sessionStats describes one relayed session once its target is known.
+type sessionStats struct {
+	tunnel   string
+	client   string
+	target   string
+	started  time.Time
+	toTarget atomic.Int64
+	toClient atomic.Int64
+
+	// reason is why the session ended, set by the first error or idle
+	// timeout recorded for it.
+	reason atomic.Pointer[string]
+}
+
+// setReason records why the session ended unless a reason was already set.
+func (s *sessionStats) setReason(reason string) {
+	s.reason.CompareAndSwap(nil, &reason)
+}
+
+// closeReason is the recorded reason, or "closed" when the session ended
+// without an error.
+func (s *sessionStats) closeReason() string {
+	if reason := s.reason.Load(); reason != nil {
+		return *reason
+	}
+	return "closed"
+}
+
+// sessionInfo is the JSON form of a session listed by the admin server.
+type sessionInfo struct {
+	Tunnel        string    `json:"tunnel"`
+	Client        string    `json:"client"`
+	Target        string    `json:"target"`
+	Started       time.Time `json:"started"`
+	AgeSeconds    float64   `json:"age_seconds"`
+	BytesToTarget int64     `json:"bytes_to_target"`
+	BytesToClient int64     `json:"bytes_to_client"`
+}
+
+// withSession tags logger with a short random ID for one session, so the
+// lines of concurrent sessions can be told apart in aggregated logs. The
+// client address is logged once, when the session is accepted, rather than
+// on every line.
+func withSession(logger *slog.Logger) *slog.Logger {
+	var id [4]byte
+	rand.Read(id[:])
+	return logger.With("session", hex.EncodeToString(id[:]))
+}
+
+func (t *sessionTracker) start() {
+	t.wg.Add(1)
+	t.active.Add(1)
+}
+
+func (t *sessionTracker) done() {
+	t.active.Add(-1)
+	t.wg.Done()
+}
+
+// track registers a session between client and target and returns the
+// metrics to relay it with, which also count its bytes, and a function that
+// unregisters it and writes its access log line.
+func (t *sessionTracker) track(metrics *tunnelMetrics, client, target string) (*tunnelMetrics, func()) {
+	stats := &sessionStats{tunnel: metrics.tunnel, client: client, target: target, started: time.Now()}
+	t.mu.Lock()
+	if t.open == nil {
+		t.open = make(map[*sessionStats]struct{})
+	}
+	t.open[stats] = struct{}{}
+	t.mu.Unlock()
+
+	untrack := func() {
+		t.mu.Lock()
+		delete(t.open, stats)
+		t.mu.Unlock()
+		logAccess(stats)
+	}
+	return metrics.forSession(stats), untrack
+}
+
+// list returns the tracked sessions, oldest first.
+func (t *sessionTracker) list() []sessionInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sessions := make([]sessionInfo, 0, len(t.open))
+	for stats := range t.open {
+		sessions = append(sessions, sessionInfo{
+			Tunnel:        stats.tunnel,
+			Client:        stats.client,
+			Target:        stats.target,
+			Started:       stats.started,
+			AgeSeconds:    time.Since(stats.started).Seconds(),
+			BytesToTarget: stats.toTarget.Load(),
+			BytesToClient: stats.toClient.Load(),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	return sessions
+}
+
+// wait blocks until every session has finished or the timeout expires, and
+// reports whether all sessions finished.
+func (t *sessionTracker) wait(timeout time.Duration) bool {
+	select {
+	case <-t.finished():
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// finished returns a channel that is closed once every session has finished.
+func (t *sessionTracker) finished() <-chan struct{} {
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	return finished
+}
+
+// activity records when a session last carried traffic in either direction.
+type activity struct {
+	lastActive atomic.Int64
+}
+
+func (a *activity) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, a.lastActive.Load()))
+}
+
+// setIdleDeadline arms a read deadline on conn so a blocked read wakes up to
+// check for idleness. A zero timeout disables it.
+func (a *activity) setIdleDeadline(conn net.Conn, timeout time.Duration) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout - a.idle()))
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// socketSettings holds the socket options read by setupSocketOptions. They
+// apply to accepted client connections, native UDP listeners and the
+// sockets dialed to targets and brokers; unset options keep Go's defaults.
+var socketSettings struct {
+	// noDelay, when set, overrides TCP_NODELAY, which Go enables by
+	// default.
+	noDelay *bool
+
+	// keepAlive is the TCP keep-alive period. Zero keeps Go's default and a
+	// negative value disables keep-alives.
+	keepAlive time.Duration
+
+	// sendBuffer and receiveBuffer set SO_SNDBUF and SO_RCVBUF when
+	// non-zero.
+	sendBuffer    int
+	receiveBuffer int
+
+	// zeroCopy relays between two plain TCP connections with splice on
+	// Linux instead of copying through a user-space buffer. It rules out
+	// the idle and write deadlines; see setupTimeouts.
+	zeroCopy bool
+}
+
+// setupSocketOptions reads TCP_NODELAY (true or false), TCP_KEEPALIVE (the
+// keep-alive period, 0 to disable), SOCKET_SEND_BUFFER and
+// SOCKET_RECEIVE_BUFFER (bytes, optionally with a Ki, Mi or Gi suffix) and
+// ZERO_COPY (true to splice plain TCP sessions).
+func setupSocketOptions() error {
+	if value := os.Getenv("TCP_NODELAY"); value != "" {
+		noDelay, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid TCP_NODELAY: %s", value)
+		}
+		socketSettings.noDelay = &noDelay
+	}
+
+	if value := os.Getenv("TCP_KEEPALIVE"); value != "" {
+		period, err := time.ParseDuration(value)
+		if value == "0" {
+			period, err = -1, nil
+		}
+		if err != nil || period == 0 {
+			return fmt.Errorf("invalid TCP_KEEPALIVE: %s", value)
+		}
+		socketSettings.keepAlive = period
+	}
+
+	for _, setting := range []struct {
+		name string
+		size *int
+	}{
+		{"SOCKET_SEND_BUFFER", &socketSettings.sendBuffer},
+		{"SOCKET_RECEIVE_BUFFER", &socketSettings.receiveBuffer},
+	} {
+		value := os.Getenv(setting.name)
+		if value == "" {
+			continue
+		}
+		size, err := parseByteSize(value)
+		if err != nil || size <= 0 || size > 1<<30 {
+			return fmt.Errorf("invalid %s: %s", setting.name, value)
+		}
+		*setting.size = int(size)
+	}
+
+	socketSettings.zeroCopy = os.Getenv("ZERO_COPY") == "true"
+	return nil
+}
+
+// tuneConn applies the configured socket options to conn. Failures are not
+// fatal: the connection works with the options it already has.
+func tuneConn(conn net.Conn) {
+	type bufferedSocket interface {
+		SetReadBuffer(bytes int) error
+		SetWriteBuffer(bytes int) error
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if socketSettings.noDelay != nil {
+			tcpConn.SetNoDelay(*socketSettings.noDelay)
+		}
+		switch {
+		case socketSettings.keepAlive > 0:
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(socketSettings.keepAlive)
+		case socketSettings.keepAlive < 0:
+			tcpConn.SetKeepAlive(false)
+		}
+	}
+	if socket, ok := conn.(bufferedSocket); ok {
+		if socketSettings.sendBuffer > 0 {
+			socket.SetWriteBuffer(socketSettings.sendBuffer)
+		}
+		if socketSettings.receiveBuffer > 0 {
+			socket.SetReadBuffer(socketSettings.receiveBuffer)
+		}
+	}
+}
+
+// tunedListener applies the socket options to every accepted connection.
+type tunedListener struct {
+	net.Listener
+}
+
+func (l tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		tuneConn(conn)
+	}
+	return conn, err
+}
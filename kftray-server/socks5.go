@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 protocol constants from RFC 1928.
+const (
+	socksVersion = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded          = 0x00
+	socksReplyGeneralFailure     = 0x01
+	socksReplyHostUnreachable    = 0x04
+	socksReplyConnectionRefused  = 0x05
+	socksReplyCommandUnsupported = 0x07
+	socksReplyAddressUnsupported = 0x08
+)
+
+// startSOCKS5Proxy serves SOCKS5 CONNECT requests, relaying each connection
+// to the destination the client asks for, so one forwarded port reaches any
+// service the cluster network can. Only the no-authentication method is
+// offered; access is controlled by TLS, AUTH_PSK and admission control.
+func (r *relay) startSOCKS5Proxy(tunnel tunnelConfig) error {
+	return r.serveTCP(tunnel, "SOCKS5 proxy listening", r.handleSOCKS5Connection)
+}
+
+func (r *relay) handleSOCKS5Connection(conn net.Conn, logger *slog.Logger, metrics *tunnelMetrics) {
+	defer conn.Close()
+
+	conn, err := r.handshake(conn)
+	if err != nil {
+		metrics.error("auth")
+		logger.Warn("Rejected connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(authTimeout))
+	targetAddr, err := readSOCKS5Request(conn)
+	if err != nil {
+		metrics.error("socks")
+		logger.Warn("Invalid SOCKS5 request", "error", err)
+		return
+	}
+
+	metrics.connOpened()
+	defer metrics.connClosed()
+
+	upstream, err := dialTarget(targetAddr)
+	if err != nil {
+		writeSOCKS5Reply(conn, socksDialReply(err), nil)
+		metrics.error("dial")
+		logger.Error("Failed to connect to target", "target", targetAddr, "error", err)
+		return
+	}
+	if err := writeSOCKS5Reply(conn, socksReplySucceeded, upstream.LocalAddr()); err != nil {
+		upstream.Close()
+		metrics.error("write")
+		logger.Error("Failed to send SOCKS5 reply", "error", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	logger.Info("Established TCP connection", "target", targetAddr)
+	r.pipe(conn, upstream, logger, metrics)
+}
+
+// readSOCKS5Request negotiates the authentication method and reads the
+// CONNECT request, returning the requested destination as host:port.
+func readSOCKS5Request(conn net.Conn) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", fmt.Errorf("failed to read greeting: %w", err)
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", fmt.Errorf("failed to read auth methods: %w", err)
+	}
+	method := byte(socksMethodNoAcceptable)
+	for _, m := range methods {
+		if m == socksMethodNoAuth {
+			method = socksMethodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", fmt.Errorf("failed to select auth method: %w", err)
+	}
+	if method == socksMethodNoAcceptable {
+		return "", errors.New("client offered no supported auth method")
+	}
+
+	var request [4]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return "", fmt.Errorf("failed to read request: %w", err)
+	}
+	if request[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	if request[1] != socksCmdConnect {
+		writeSOCKS5Reply(conn, socksReplyCommandUnsupported, nil)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if request[3] == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", fmt.Errorf("failed to read address: %w", err)
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return "", fmt.Errorf("failed to read address: %w", err)
+		}
+		if length[0] == 0 {
+			// An empty host would dial the relay's own address.
+			writeSOCKS5Reply(conn, socksReplyAddressUnsupported, nil)
+			return "", errors.New("empty domain name")
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", fmt.Errorf("failed to read address: %w", err)
+		}
+		host = string(domain)
+	default:
+		writeSOCKS5Reply(conn, socksReplyAddressUnsupported, nil)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", fmt.Errorf("failed to read port: %w", err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeSOCKS5Reply sends a reply with the given code and bound address,
+// which is reported as 0.0.0.0:0 when nil.
+func writeSOCKS5Reply(conn net.Conn, code byte, bound net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if tcpAddr, ok := bound.(*net.TCPAddr); ok {
+		port = tcpAddr.Port
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			ip = ip4
+		} else {
+			ip = tcpAddr.IP
+		}
+	}
+
+	addrType := byte(socksAddrIPv4)
+	if len(ip) == net.IPv6len {
+		addrType = socksAddrIPv6
+	}
+	reply := append([]byte{socksVersion, code, 0x00, addrType}, ip...)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socksDialReply maps a dial failure to the closest SOCKS5 reply code.
+func socksDialReply(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksReplyConnectionRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH), isTimeout(err):
+		return socksReplyHostUnreachable
+	default:
+		return socksReplyGeneralFailure
+	}
+}
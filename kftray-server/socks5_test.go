@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadSOCKS5Request(t *testing.T) {
+	noAuth := []byte{socksVersion, 1, socksMethodNoAuth}
+	connect := func(addrType byte, addr ...byte) []byte {
+		request := append([]byte{socksVersion, socksCmdConnect, 0x00, addrType}, addr...)
+		return append(request, 0x01, 0xbb)
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	ipv6 := net.ParseIP("2001:db8::1").To16()
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string
+		replies []byte // the replies the client must receive, in order
+		wantErr bool
+	}{
+		{
+			name:    "IPv4",
+			input:   join(noAuth, connect(socksAddrIPv4, 192, 0, 2, 1)),
+			want:    "192.0.2.1:443",
+			replies: []byte{socksVersion, socksMethodNoAuth},
+		},
+		{
+			name:    "IPv6",
+			input:   join(noAuth, connect(socksAddrIPv6, ipv6...)),
+			want:    "[2001:db8::1]:443",
+			replies: []byte{socksVersion, socksMethodNoAuth},
+		},
+		{
+			name:    "domain",
+			input:   join(noAuth, connect(socksAddrDomain, append([]byte{11}, "example.com"...)...)),
+			want:    "example.com:443",
+			replies: []byte{socksVersion, socksMethodNoAuth},
+		},
+		{
+			name:    "no-auth among other methods",
+			input:   join([]byte{socksVersion, 3, 0x02, 0x01, socksMethodNoAuth}, connect(socksAddrIPv4, 10, 0, 0, 1)),
+			want:    "10.0.0.1:443",
+			replies: []byte{socksVersion, socksMethodNoAuth},
+		},
+		{
+			name:    "no acceptable method",
+			input:   []byte{socksVersion, 1, 0x02},
+			replies: []byte{socksVersion, socksMethodNoAcceptable},
+			wantErr: true,
+		},
+		{
+			name:    "no methods",
+			input:   []byte{socksVersion, 0},
+			replies: []byte{socksVersion, socksMethodNoAcceptable},
+			wantErr: true,
+		},
+		{
+			name:    "SOCKS4 greeting",
+			input:   []byte{0x04, socksCmdConnect, 0x01, 0xbb, 192, 0, 2, 1, 0x00},
+			wantErr: true,
+		},
+		{
+			name:    "truncated greeting",
+			input:   []byte{socksVersion},
+			wantErr: true,
+		},
+		{
+			name:    "truncated methods",
+			input:   []byte{socksVersion, 2, socksMethodNoAuth},
+			wantErr: true,
+		},
+		{
+			name:    "wrong request version",
+			input:   join(noAuth, []byte{0x04, socksCmdConnect, 0x00, socksAddrIPv4, 192, 0, 2, 1, 0x01, 0xbb}),
+			replies: []byte{socksVersion, socksMethodNoAuth},
+			wantErr: true,
+		},
+		{
+			name:    "BIND",
+			input:   join(noAuth, []byte{socksVersion, 0x02, 0x00, socksAddrIPv4, 192, 0, 2, 1, 0x01, 0xbb}),
+			replies: []byte{socksVersion, socksMethodNoAuth, socksVersion, socksReplyCommandUnsupported},
+			wantErr: true,
+		},
+		{
+			name:    "unknown address type",
+			input:   join(noAuth, connect(0x05, 192, 0, 2, 1)),
+			replies: []byte{socksVersion, socksMethodNoAuth, socksVersion, socksReplyAddressUnsupported},
+			wantErr: true,
+		},
+		{
+			name:    "empty domain",
+			input:   join(noAuth, connect(socksAddrDomain, 0)),
+			replies: []byte{socksVersion, socksMethodNoAuth, socksVersion, socksReplyAddressUnsupported},
+			wantErr: true,
+		},
+		{
+			name:    "truncated IPv6 address",
+			input:   join(noAuth, []byte{socksVersion, socksCmdConnect, 0x00, socksAddrIPv6}, ipv6[:8]),
+			replies: []byte{socksVersion, socksMethodNoAuth},
+			wantErr: true,
+		},
+		{
+			name:    "truncated domain",
+			input:   join(noAuth, []byte{socksVersion, socksCmdConnect, 0x00, socksAddrDomain, 11}, []byte("example")),
+			replies: []byte{socksVersion, socksMethodNoAuth},
+			wantErr: true,
+		},
+		{
+			name:    "missing port",
+			input:   join(noAuth, []byte{socksVersion, socksCmdConnect, 0x00, socksAddrIPv4, 192, 0, 2, 1}),
+			replies: []byte{socksVersion, socksMethodNoAuth},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			replies := make(chan []byte)
+			go func() {
+				got, _ := io.ReadAll(client)
+				replies <- got
+			}()
+			go func() {
+				client.Write(tt.input)
+				client.CloseWrite()
+			}()
+
+			got, err := readSOCKS5Request(server)
+			server.Close()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readSOCKS5Request() = %q, %v; wantErr %v", got, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readSOCKS5Request() = %q, want %q", got, tt.want)
+			}
+			if sent := <-replies; !bytes.HasPrefix(sent, tt.replies) {
+				t.Errorf("replies = %x, want prefix %x", sent, tt.replies)
+			}
+		})
+	}
+}
+
+func TestWriteSOCKS5Reply(t *testing.T) {
+	tests := []struct {
+		name  string
+		bound net.Addr
+		want  []byte
+	}{
+		{
+			name: "unbound",
+			want: []byte{socksVersion, socksReplyGeneralFailure, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:  "IPv4",
+			bound: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+			want:  []byte{socksVersion, socksReplyGeneralFailure, 0x00, socksAddrIPv4, 10, 0, 0, 1, 0x01, 0xbb},
+		},
+		{
+			name:  "IPv6",
+			bound: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			want:  append(append([]byte{socksVersion, socksReplyGeneralFailure, 0x00, socksAddrIPv6}, net.ParseIP("2001:db8::1")...), 0x01, 0xbb),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go func() {
+				writeSOCKS5Reply(server, socksReplyGeneralFailure, tt.bound)
+				server.Close()
+			}()
+			got, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("reply = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// spliceChunkSize is how many bytes are spliced between updates of the
+// byte counters.
+const spliceChunkSize = 1 << 20
+
+// splicePair returns the TCP connections behind dst and src when ZERO_COPY
+// is enabled and both legs are plain TCP, with no TLS or compression layered
+// on top, so the kernel can move the data between them.
+func splicePair(dst, src net.Conn) (*net.TCPConn, *net.TCPConn, bool) {
+	if !socketSettings.zeroCopy {
+		return nil, nil, false
+	}
+	tcpDst, ok := unwrapDeadlines(dst).(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	tcpSrc, ok := unwrapDeadlines(src).(*net.TCPConn)
+	return tcpDst, tcpSrc, ok
+}
+
+func unwrapDeadlines(conn net.Conn) net.Conn {
+	if c, ok := conn.(*deadlineConn); ok {
+		return c.Conn
+	}
+	return conn
+}
+
+// spliceStream copies src to dst through TCPConn.ReadFrom, which uses
+// splice(2) on Linux and a plain copy elsewhere, until src reaches EOF.
+// Relayed bytes are counted once per chunk, too coarsely to enforce the idle
+// and write deadlines, which setupTimeouts keeps off with ZERO_COPY. Any
+// deadline still left on the raw connections is cleared first.
+func spliceStream(dst, src *net.TCPConn, count func(int)) error {
+	dst.SetWriteDeadline(time.Time{})
+	src.SetReadDeadline(time.Time{})
+	for {
+		n, err := dst.ReadFrom(&io.LimitedReader{R: src, N: spliceChunkSize})
+		if n > 0 {
+			count(int(n))
+		}
+		if err != nil || n < spliceChunkSize {
+			return err
+		}
+	}
+}
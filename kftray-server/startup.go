@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Exit codes, one per class of failure, so supervisors and scripts can tell
+// a mistyped setting from a missing secret or a failure at runtime.
+const (
+	exitRuntime     = 1
+	exitUsage       = 2
+	exitConfig      = 3
+	exitCredentials = 4
+)
+
+// startupProblems collects every invalid setting found while loading the
+// configuration, so all of them are reported together instead of one per
+// restart.
+type startupProblems struct {
+	config      []error
+	credentials []error
+}
+
+// add records err, and each error joined into it, as a configuration
+// problem. A nil err is ignored.
+func (p *startupProblems) add(err error) {
+	p.config = append(p.config, splitErrors(err)...)
+}
+
+// addCredentials records err as a problem loading TLS material or the
+// pre-shared key.
+func (p *startupProblems) addCredentials(err error) {
+	p.credentials = append(p.credentials, splitErrors(err)...)
+}
+
+// exitIfAny logs every recorded problem and exits, with exitConfig when any
+// setting is invalid and exitCredentials when only credentials failed to
+// load.
+func (p *startupProblems) exitIfAny() {
+	total := len(p.config) + len(p.credentials)
+	if total == 0 {
+		return
+	}
+	for _, err := range p.config {
+		slog.Error("Invalid configuration", "error", err)
+	}
+	for _, err := range p.credentials {
+		slog.Error("Invalid credentials", "error", err)
+	}
+	code := exitConfig
+	if len(p.config) == 0 {
+		code = exitCredentials
+	}
+	slog.Error("Refusing to start", "problems", total, "exit_code", code)
+	os.Exit(code)
+}
+
+func splitErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []error
+		for _, e := range joined.Unwrap() {
+			errs = append(errs, splitErrors(e)...)
+		}
+		return errs
+	}
+	return []error{err}
+}
+
+// exit logs msg at error level and exits with code.
+func exit(code int, msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(code)
+}
+
+// logEffectiveConfig logs the settings the relay starts with, after
+// defaults have been applied, so a misread variable is visible at a glance.
+func (r *relay) logEffectiveConfig(tunnels []tunnelConfig, adminPort int, adminPprof bool, shutdownTimeout, reloadInterval time.Duration) {
+	names := make([]string, len(tunnels))
+	for i, tunnel := range tunnels {
+		names[i] = tunnel.Name
+	}
+	listenAddress := r.listenHost
+	if listenAddress == "" {
+		listenAddress = "all interfaces"
+	}
+	slog.Info("Effective configuration",
+		"tunnels", strings.Join(names, ","),
+		"listen_address", listenAddress,
+		"admin_port", adminPort,
+		"admin_pprof", adminPprof,
+		"tls", r.security.tlsConfig != nil,
+		"auth_psk", r.security.psk != nil,
+		"broker_tls", r.security.brokerTLS != nil,
+		"compression", r.compression != compressionNone,
+		"protocol_handshake", r.versionHandshake,
+		"proxy_protocol_accept", r.proxyProtocol.accept,
+		"proxy_protocol_send", r.proxyProtocol.send,
+		"heartbeat_interval", r.heartbeatInterval.String(),
+		"udp_session_timeout", r.udpIdleTimeout.String(),
+		"dns_refresh_interval", r.dnsRefreshInterval.String(),
+		"health_check_interval", r.healthCheckInterval.String(),
+		"config_reload_interval", reloadInterval.String(),
+		"shutdown_timeout", shutdownTimeout.String(),
+		"dial_timeout", timeoutSettings.dial.String(),
+		"idle_timeout", timeoutSettings.idle.String(),
+		"write_timeout", timeoutSettings.write.String(),
+		"udp_buffer_size", bufferSettings.maxDatagram,
+		"max_frame_size", frameSettings.maxLength,
+		"frame_checksum", frameSettings.checksum,
+		"zero_copy", socketSettings.zeroCopy,
+		"access_log", accessLog != nil,
+		"hot_restart", listenConfig.Control != nil,
+	)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	healthCheckTimeout         = 2 * time.Second
+
+	// srvPrefix marks a remote_address entry that is expanded through an
+	// SRV lookup, e.g. "srv:_dns._udp.kube-dns.kube-system.svc.cluster.local".
+	srvPrefix = "srv:"
+)
+
+// target is one backend of a tunnel.
+type target struct {
+	addr     string
+	srv      string
+	down     atomic.Bool
+	resolver *targetResolver
+}
+
+// targetPool spreads new connections and sessions over the tunnel's targets
+// round-robin. remote_address may list several comma-separated hosts (each
+// optionally with its own port) and SRV names; with more than one target,
+// stream tunnels check each target with a TCP dial and skip the ones that
+// fail. Datagram targets cannot be probed and are only rotated.
+type targetPool struct {
+	specs    []string
+	port     int
+	datagram bool
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	targets []*target
+	counter atomic.Uint32
+}
+
+func newTargetPool(tunnel tunnelConfig, dnsRefreshInterval time.Duration, logger *slog.Logger) *targetPool {
+	p := &targetPool{
+		specs:    splitTargets(tunnel.RemoteAddress),
+		port:     tunnel.RemotePort,
+		datagram: tunnel.datagramTarget(),
+		interval: dnsRefreshInterval,
+		logger:   logger,
+	}
+	p.refresh()
+	return p
+}
+
+// splitTargets returns the comma-separated entries of remote_address.
+func splitTargets(remoteAddress string) []string {
+	var specs []string
+	for _, spec := range strings.Split(remoteAddress, ",") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+// validateTargets checks the remote_address entries, which need remote_port
+// unless they carry their own port or are SRV names.
+func validateTargets(remoteAddress string, port int) error {
+	specs := splitTargets(remoteAddress)
+	if len(specs) == 0 {
+		return errors.New("remote_address is required")
+	}
+	for _, spec := range specs {
+		if name, ok := strings.CutPrefix(spec, srvPrefix); ok {
+			if name == "" {
+				return fmt.Errorf("invalid remote_address entry: %s", spec)
+			}
+			continue
+		}
+		if _, _, err := net.SplitHostPort(spec); err == nil {
+			continue
+		}
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid remote_port: %d", port)
+		}
+	}
+	return nil
+}
+
+// refresh expands the entries into target addresses, looking SRV names up
+// again. Targets that are still listed keep their health and resolver state,
+// and the previous targets of an SRV name are kept when its lookup fails.
+func (p *targetPool) refresh() {
+	p.mu.Lock()
+	previous := p.targets
+	p.mu.Unlock()
+
+	var found []*target
+	for _, spec := range p.specs {
+		name, ok := strings.CutPrefix(spec, srvPrefix)
+		if !ok {
+			addr := spec
+			if _, _, err := net.SplitHostPort(spec); err != nil {
+				addr = net.JoinHostPort(unbracket(spec), strconv.Itoa(p.port))
+			}
+			found = append(found, &target{addr: addr})
+			continue
+		}
+		_, records, err := net.LookupSRV("", "", name)
+		if err != nil {
+			p.logger.Warn("Failed to look up SRV targets", "name", name, "error", err)
+			for _, t := range previous {
+				if t.srv == name {
+					found = append(found, &target{addr: t.addr, srv: name})
+				}
+			}
+			continue
+		}
+		for _, record := range records {
+			addr := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+			found = append(found, &target{addr: addr, srv: name})
+		}
+	}
+
+	existing := make(map[string]*target, len(previous))
+	for _, t := range previous {
+		existing[t.addr] = t
+	}
+	targets := make([]*target, 0, len(found))
+	for _, t := range found {
+		if old, ok := existing[t.addr]; ok {
+			t = old
+		} else {
+			t.resolver = newTargetResolver(t.addr, p.interval, p.logger)
+		}
+		targets = append(targets, t)
+	}
+
+	p.mu.Lock()
+	p.targets = targets
+	p.mu.Unlock()
+}
+
+// candidates returns the healthy targets in round-robin order, followed by
+// the failing ones as a last resort.
+func (p *targetPool) candidates() []*target {
+	p.mu.Lock()
+	targets := p.targets
+	p.mu.Unlock()
+
+	var healthy, down []*target
+	for _, t := range targets {
+		if t.down.Load() {
+			down = append(down, t)
+		} else {
+			healthy = append(healthy, t)
+		}
+	}
+	if len(healthy) > 1 {
+		start := int(p.counter.Add(1)) % len(healthy)
+		healthy = append(healthy[start:], healthy[:start]...)
+	}
+	return append(healthy, down...)
+}
+
+// pick returns the target for a new datagram session.
+func (p *targetPool) pick() (*target, error) {
+	candidates := p.candidates()
+	if len(candidates) == 0 {
+		return nil, errors.New("no targets available")
+	}
+	return candidates[0], nil
+}
+
+// dial connects to the next target, moving on to the others in turn when a
+// dial fails, and returns the address it connected to.
+func (p *targetPool) dial() (net.Conn, string, error) {
+	candidates := p.candidates()
+	if len(candidates) == 0 {
+		return nil, "", errors.New("no targets available")
+	}
+	var errs []error
+	for _, t := range candidates {
+		conn, err := dialTarget(t.addr)
+		if err == nil {
+			return conn, t.addr, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, candidates[0].addr, errors.Join(errs...)
+}
+
+// maintain refreshes SRV targets every DNS refresh interval and, for stream
+// tunnels with several targets, health checks them every check interval,
+// until ctx ends.
+func (p *targetPool) maintain(ctx context.Context, checkInterval time.Duration) {
+	hasSRV := false
+	for _, spec := range p.specs {
+		hasSRV = hasSRV || strings.HasPrefix(spec, srvPrefix)
+	}
+	checks := !p.datagram && checkInterval > 0 && (hasSRV || len(p.specs) > 1)
+
+	var refresh, check <-chan time.Time
+	if hasSRV && p.interval > 0 {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+	if checks {
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		check = ticker.C
+		p.checkHealth()
+	}
+	if refresh == nil && check == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh:
+			p.refresh()
+		case <-check:
+			p.checkHealth()
+		}
+	}
+}
+
+func (p *targetPool) checkHealth() {
+	p.mu.Lock()
+	targets := p.targets
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", t.addr, healthCheckTimeout)
+			if err == nil {
+				conn.Close()
+			}
+			down := err != nil
+			if t.down.Swap(down) != down {
+				if down {
+					p.logger.Warn("Target failed health check", "target", t.addr, "error", err)
+				} else {
+					p.logger.Info("Target passed health check", "target", t.addr)
+				}
+			}
+		}(t)
+	}
+	wg.Wait()
+}
+
+// targetsFor builds the tunnel's target pool and maintains it until the
+// tunnel stops.
+func (r *relay) targetsFor(tunnel tunnelConfig, logger *slog.Logger) *targetPool {
+	pool := newTargetPool(tunnel, r.dnsRefreshInterval, logger)
+	go pool.maintain(r.ctx, r.healthCheckInterval)
+	return pool
+}
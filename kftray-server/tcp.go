@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+const tcpBufferSize = 32 * 1024
+
+// startTCPProxy relays TCP connections to the target after applying the
+// configured transport security and admission control.
+func (r *relay) startTCPProxy(tunnel tunnelConfig) error {
+	targets := r.targetsFor(tunnel, slog.With("tunnel", tunnel.Name))
+	return r.serveTCP(tunnel, "TCP proxy listening", func(conn net.Conn, logger *slog.Logger, metrics *tunnelMetrics) {
+		r.relayTCP(conn, targets, logger, metrics)
+	})
+}
+
+// serveTCP accepts connections on the tunnel's port and passes each admitted
+// one to handle, which owns the connection from then on. It returns an error
+// only when the listener cannot be opened.
+func (r *relay) serveTCP(tunnel tunnelConfig, listening string, handle func(conn net.Conn, logger *slog.Logger, metrics *tunnelMetrics)) error {
+	logger := slog.With("tunnel", tunnel.Name)
+	listener, err := r.listenStream(tunnel.LocalPort)
+	if err != nil {
+		return fmt.Errorf("failed to start TCP listener: %w", err)
+	}
+	defer listener.Close()
+	r.closeOnShutdown(listener)
+	r.ready.markReady(tunnel.Name)
+
+	logger.Info(listening, "port", tunnel.LocalPort, "target", tunnel.targetDescription())
+
+	metrics := newTunnelMetrics(tunnel.Name)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if r.shuttingDown(err) {
+				return nil
+			}
+			metrics.error("accept")
+			logger.Error("Failed to accept connection", "error", err)
+			continue
+		}
+		release, err := r.admission.admit(conn.RemoteAddr())
+		if err != nil {
+			metrics.error(rejectionKind(err))
+			logger.Warn("Rejected connection", "client", conn.RemoteAddr().String(), "error", err)
+			conn.Close()
+			continue
+		}
+		r.sessions.start()
+		go func() {
+			defer r.sessions.done()
+			defer release()
+			logger := withSession(logger)
+			defer recoverPanic(logger, metrics)
+			logger.Info("Accepted connection", "client", conn.RemoteAddr().String())
+			handle(conn, logger, metrics)
+		}()
+	}
+}
+
+func (r *relay) relayTCP(conn net.Conn, targets *targetPool, logger *slog.Logger, metrics *tunnelMetrics) {
+	defer conn.Close()
+
+	conn, err := r.handshake(conn)
+	if err != nil {
+		metrics.error("auth")
+		logger.Warn("Rejected connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	metrics.connOpened()
+	defer metrics.connClosed()
+
+	upstream, targetAddr, err := targets.dial()
+	if err != nil {
+		metrics.error("dial")
+		logger.Error("Failed to connect to target", "target", targetAddr, "error", err)
+		return
+	}
+	logger.Info("Established TCP connection", "target", targetAddr)
+	r.pipe(conn, upstream, logger, metrics)
+}
+
+func dialTarget(targetAddr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeoutSettings.dial}
+	conn, err := dialer.Dial("tcp", targetAddr)
+	if err == nil {
+		tuneConn(conn)
+	}
+	return conn, err
+}
+
+// pipe copies between the client and upstream connections in both
+// directions. When one side finishes sending, the other side's write half
+// is closed and the opposite direction keeps flowing until it finishes too.
+// A failure in either direction, including an expired write deadline, or
+// the session idling past the idle timeout closes both connections at once.
+// The session is listed by the admin server while it runs.
+func (r *relay) pipe(conn, upstream net.Conn, logger *slog.Logger, metrics *tunnelMetrics) {
+	defer upstream.Close()
+	conn, upstream, session := withDeadlines(conn, upstream)
+	if err := r.sendProxyHeader(conn, upstream); err != nil {
+		metrics.error("write")
+		logger.Error("Failed to send PROXY header", "error", err)
+		return
+	}
+	metrics, untrack := r.sessions.track(metrics, conn.RemoteAddr().String(), upstream.RemoteAddr().String())
+	defer untrack()
+
+	// Closing both connections unblocks whichever copy is still running.
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			conn.Close()
+			upstream.Close()
+		})
+	}
+	defer closeBoth()
+	defer watchIdle(session, func() {
+		defer recoverPanic(logger, metrics)
+		metrics.error("timeout")
+		logger.Info("Closing idle TCP connection", "idle_timeout", timeoutSettings.idle)
+		closeBoth()
+	})()
+
+	forward := func(dst, src net.Conn, count func(int)) {
+		if copyStream(dst, src, count, logger, metrics) == nil && closeWrite(dst) == nil {
+			return
+		}
+		closeBoth()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer recoverPanic(logger, metrics)
+		forward(upstream, conn, metrics.relayedToTarget)
+	}()
+	go func() {
+		defer wg.Done()
+		defer recoverPanic(logger, metrics)
+		forward(conn, upstream, metrics.relayedToClient)
+	}()
+	wg.Wait()
+}
+
+// copyStream copies src to dst until src reaches EOF, which returns nil, or
+// either side fails, counting relayed bytes. Errors caused by the
+// connection being closed are expected and not reported.
+func copyStream(dst, src net.Conn, count func(int), logger *slog.Logger, metrics *tunnelMetrics) error {
+	var err error
+	if tcpDst, tcpSrc, ok := splicePair(dst, src); ok {
+		err = spliceStream(tcpDst, tcpSrc, count)
+	} else {
+		buf := streamBuffers.get()
+		defer streamBuffers.put(buf)
+		_, err = io.CopyBuffer(countingWriter{dst, count}, src, *buf)
+	}
+	if isTimeout(err) {
+		metrics.error("timeout")
+		logger.Info("Closing TCP connection after deadline expired", "error", err)
+	} else if err != nil && !errors.Is(err, net.ErrClosed) {
+		metrics.error("copy")
+		logger.Debug("TCP copy ended with error", "error", err)
+	}
+	return err
+}
+
+// closeWriter is implemented by connections that can close their write
+// half while still reading, such as *net.TCPConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite signals EOF to the peer of conn without closing it for reading.
+// It fails when conn cannot be half-closed, in which case the caller should
+// close it entirely.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// loadTLSConfig builds the server TLS configuration from TLS_CERT/TLS_KEY, or
+// from a freshly generated self-signed certificate when TLS_SELF_SIGNED=true.
+// When TLS_CLIENT_CA is set, clients must present a certificate signed by it.
+// It returns nil when TLS is not configured.
+func loadTLSConfig() (*tls.Config, error) {
+	certFile := os.Getenv("TLS_CERT")
+	keyFile := os.Getenv("TLS_KEY")
+	selfSigned := os.Getenv("TLS_SELF_SIGNED") == "true"
+	clientCAFile := os.Getenv("TLS_CLIENT_CA")
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("TLS_CERT and TLS_KEY must be set together")
+		}
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS key pair: %w", err)
+		}
+		slog.Info("Loaded TLS certificate", "path", certFile)
+	case selfSigned:
+		cert, err = generateSelfSignedCert()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate self-signed certificate: %w", err)
+		}
+		fingerprint := sha256.Sum256(cert.Certificate[0])
+		slog.Info("Generated self-signed TLS certificate", "sha256_fingerprint", hex.EncodeToString(fingerprint[:]))
+	default:
+		if clientCAFile != "" {
+			return nil, errors.New("TLS_CLIENT_CA requires TLS_CERT/TLS_KEY or TLS_SELF_SIGNED")
+		}
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		slog.Info("Requiring client certificates", "ca", clientCAFile)
+	}
+
+	return config, nil
+}
+
+// loadBrokerTLSConfig builds the TLS configuration reverse tunnels dial their
+// broker with. TLS is used when TLS_BROKER_CA is set, verifying the broker
+// against that CA instead of the system roots, or when server TLS is
+// configured, whose certificate is then presented as the client certificate.
+// It returns nil when neither is set.
+func loadBrokerTLSConfig(server *tls.Config) (*tls.Config, error) {
+	caFile := os.Getenv("TLS_BROKER_CA")
+	if caFile == "" && server == nil {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if server != nil {
+		config.Certificates = server.Certificates
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+		slog.Info("Verifying broker certificates", "ca", caFile)
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA %s", caFile)
+	}
+	return pool, nil
+}
+
+func generateSelfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "kftray-server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// listenTCP opens the TCP listener for the proxy port, wrapping it in TLS
+// when tlsConfig is non-nil. When trustedProxies is non-empty, only clients
+// within it are accepted and each must send a PROXY header, which precedes
+// the TLS handshake. Accepting waits while the buffer memory limit is
+// reached.
+func listenTCP(addr string, tlsConfig *tls.Config, trustedProxies []*net.IPNet) (net.Listener, error) {
+	tcpListener, err := listenConfig.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var listener net.Listener = &memoryLimitListener{Listener: tunedListener{tcpListener}}
+	if len(trustedProxies) > 0 {
+		listener = newProxyProtocolListener(listener, trustedProxies)
+	}
+	if tlsConfig != nil {
+		return tls.NewListener(listener, tlsConfig), nil
+	}
+	return listener, nil
+}
+
+// completeHandshake forces the TLS handshake on conn, if it is a TLS
+// connection, so that rejected clients are dropped before the target is dialed.
+func completeHandshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer tlsConn.SetDeadline(time.Time{})
+	return tlsConn.Handshake()
+}
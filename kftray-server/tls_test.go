@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues client certificates for mutual TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kftray test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a client certificate signed by the CA.
+func (ca *testCA) issue(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "kftray test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestClientCertificates relays through a tunnel that requires client
+// certificates signed by TLS_CLIENT_CA, and checks that only clients
+// presenting one get through.
+func TestClientCertificates(t *testing.T) {
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TLS_SELF_SIGNED", "true")
+	t.Setenv("TLS_CLIENT_CA", caFile)
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRelay(t)
+	r.security.tlsConfig = tlsConfig
+	addr := startEchoTunnel(t, r, "tcp")
+
+	tests := []struct {
+		name    string
+		certs   []tls.Certificate
+		wantErr bool
+	}{
+		{name: "certificate from TLS_CLIENT_CA", certs: []tls.Certificate{ca.issue(t)}},
+		{name: "no certificate", wantErr: true},
+		{name: "certificate from another CA", certs: []tls.Certificate{otherCA.issue(t)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", addr, &tls.Config{
+				Certificates:       tt.certs,
+				InsecureSkipVerify: true,
+			})
+			if err == nil {
+				// With TLS 1.3 the server checks the client certificate after
+				// the client's handshake completes, so a rejection surfaces
+				// on the first read.
+				defer conn.Close()
+				err = echoOver(conn)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("relay error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
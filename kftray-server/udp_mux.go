@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+const (
+	// muxHeaderSize is the 4-byte payload length followed by the 4-byte
+	// peer ID that prefixes every udp-mux frame.
+	muxHeaderSize = 8
+	maxMuxPeers   = 1024
+
+	// maxDatagramSize is the largest UDP payload, and the default and upper
+	// bound of UDP_BUFFER_SIZE.
+	maxDatagramSize = 65535
+)
+
+// muxPeer is the upstream UDP socket serving one peer ID of a multiplexed
+// tunnel; keeping one socket per peer lets replies be routed back by ID.
+type muxPeer struct {
+	activity
+	id       uint32
+	upstream *net.UDPConn
+	resolver *targetResolver
+	metrics  *tunnelMetrics
+	untrack  func()
+}
+
+// handleMuxConnection relays datagrams for many UDP peers over one TCP
+// connection. Each frame carries the peer ID it belongs to, and replies from
+// the target are framed with the same ID.
+func (r *relay) handleMuxConnection(conn net.Conn, targets *targetPool, logger *slog.Logger, metrics *tunnelMetrics) {
+	done := make(chan struct{})
+	defer close(done)
+	writer := newFrameWriter(conn, true, done, logger, metrics)
+	go r.sendHeartbeats(writer, done, logger, metrics)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	peers := make(map[uint32]*muxPeer)
+	defer func() {
+		mu.Lock()
+		for _, peer := range peers {
+			peer.upstream.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	var header [muxHeaderSize]byte
+	buf := datagramBuffers.get()
+	defer datagramBuffers.put(buf)
+	for {
+		if err := r.readHeader(conn, header[:]); err != nil {
+			if isTimeout(err) {
+				metrics.error("heartbeat")
+				logger.Warn("Closing connection after missed heartbeats", "interval", r.heartbeatInterval.String())
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				metrics.error("read")
+				logger.Error("Error reading frame header from TCP", "error", err)
+			}
+			return
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		id := binary.BigEndian.Uint32(header[4:8])
+		payload, err := readPayload(conn, *buf, length)
+		if malformedFrame(err) {
+			metrics.error("frame")
+			logger.Error("Closing connection after malformed frame", "peer", id, "bytes", length, "error", err)
+			return
+		}
+		if err != nil {
+			metrics.error("read")
+			logger.Error("Error reading from TCP", "peer", id, "error", err)
+			return
+		}
+
+		mu.Lock()
+		peer, ok := peers[id]
+		if !ok && bufferMemory.exhausted() {
+			mu.Unlock()
+			metrics.error("memory")
+			logger.Debug("Dropped datagram for new peer at buffer memory limit", "peer", id)
+			continue
+		}
+		if !ok {
+			var err error
+			peer, err = r.openMuxPeer(id, targets, len(peers))
+			if err != nil {
+				mu.Unlock()
+				metrics.error("dial")
+				logger.Error("Failed to open UDP peer", "peer", id, "error", err)
+				continue
+			}
+			peer.metrics, peer.untrack = r.sessions.track(metrics, conn.RemoteAddr().String(), peer.upstream.RemoteAddr().String())
+			peers[id] = peer
+			metrics.sessions.Inc()
+			logger.Debug("Opened UDP peer", "peer", id)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.relayMuxPeer(peer, writer, logger.With("peer", peer.id))
+				mu.Lock()
+				delete(peers, peer.id)
+				mu.Unlock()
+				peer.upstream.Close()
+				peer.untrack()
+				metrics.sessions.Dec()
+			}()
+		}
+		mu.Unlock()
+
+		peer.touch()
+		logger.Debug("TCP -> UDP", "peer", id, "bytes", length, payloadAttr(payload))
+		if _, err := peer.upstream.Write(payload); err != nil {
+			peer.resolver.invalidate()
+			metrics.error("write")
+			logger.Error("Error writing to UDP", "peer", id, "error", err)
+			continue
+		}
+		peer.metrics.relayedToTarget(int(length))
+	}
+}
+
+func (r *relay) openMuxPeer(id uint32, targets *targetPool, open int) (*muxPeer, error) {
+	if open >= maxMuxPeers {
+		return nil, fmt.Errorf("too many peers on one connection (max %d)", maxMuxPeers)
+	}
+	target, err := targets.pick()
+	if err != nil {
+		return nil, err
+	}
+	resolver := target.resolver
+	udpAddr, err := resolver.resolve()
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		resolver.invalidate()
+		return nil, err
+	}
+	tuneConn(upstream)
+	peer := &muxPeer{id: id, upstream: upstream, resolver: resolver}
+	peer.touch()
+	return peer, nil
+}
+
+// relayMuxPeer frames replies from the peer's upstream socket back onto the
+// tunnel until the peer goes idle or the tunnel closes.
+func (r *relay) relayMuxPeer(peer *muxPeer, writer *frameWriter, logger *slog.Logger) {
+	metrics := peer.metrics
+	defer recoverPanic(logger, metrics)
+	buf := datagramBuffers.get()
+	defer datagramBuffers.put(buf)
+	for {
+		peer.setIdleDeadline(peer.upstream, r.udpIdleTimeout)
+		n, err := peer.upstream.Read((*buf)[:bufferSettings.maxDatagram])
+		if err != nil {
+			if isTimeout(err) {
+				if peer.idle() < r.udpIdleTimeout {
+					continue
+				}
+				metrics.ended("idle")
+				logger.Debug("Closing idle UDP peer", "idle_timeout", r.udpIdleTimeout.String())
+				return
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				peer.resolver.invalidate()
+				metrics.error("read")
+				logger.Error("Error reading from UDP", "error", err)
+			}
+			return
+		}
+		peer.touch()
+		logger.Debug("UDP -> TCP", "bytes", n, payloadAttr((*buf)[:n]))
+
+		err = writer.writeFrame(peer.id, (*buf)[:n])
+		if errors.Is(err, errMemoryLimit) {
+			metrics.error("memory")
+			logger.Debug("Dropped datagram at buffer memory limit", "bytes", n)
+			continue
+		}
+		if err != nil {
+			metrics.error("write")
+			logger.Error("Error writing to TCP", "error", err)
+			return
+		}
+		metrics.relayedToClient(n)
+	}
+}
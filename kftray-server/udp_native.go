@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+type udpSession struct {
+	activity
+	clientAddr *net.UDPAddr
+	upstream   *net.UDPConn
+	resolver   *targetResolver
+	metrics    *tunnelMetrics
+	logger     *slog.Logger
+}
+
+func (r *relay) startNativeUDPProxy(tunnel tunnelConfig) error {
+	logger := slog.With("tunnel", tunnel.Name)
+	packetConn, err := listenConfig.ListenPacket(context.Background(), "udp", r.listenAddr(tunnel.LocalPort))
+	if err != nil {
+		return fmt.Errorf("failed to start UDP listener: %w", err)
+	}
+	conn := packetConn.(*net.UDPConn)
+	defer conn.Close()
+	tuneConn(conn)
+
+	// Datagram sessions have no end to wait for, so they are dropped as soon
+	// as shutdown begins rather than drained.
+	r.closeOnShutdown(conn)
+
+	targets := r.targetsFor(tunnel, logger)
+
+	r.ready.markReady(tunnel.Name)
+	logger.Info("Native UDP proxy listening", "port", tunnel.LocalPort)
+
+	metrics := newTunnelMetrics(tunnel.Name)
+
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	// Closing the upstream sockets ends the sessions still running when the
+	// tunnel stops, including those that never time out.
+	defer func() {
+		mu.Lock()
+		for _, session := range sessions {
+			session.upstream.Close()
+		}
+		mu.Unlock()
+	}()
+
+	buf := datagramBuffers.get()
+	defer datagramBuffers.put(buf)
+	for {
+		n, clientAddr, err := conn.ReadFromUDP((*buf)[:bufferSettings.maxDatagram])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			metrics.error("read")
+			logger.Error("Failed to read from UDP listener", "error", err)
+			continue
+		}
+
+		key := clientAddr.String()
+		mu.Lock()
+		session, ok := sessions[key]
+		if !ok {
+			if bufferMemory.exhausted() {
+				mu.Unlock()
+				metrics.error("memory")
+				logger.Debug("Dropped datagram for new session at buffer memory limit", "client", key)
+				continue
+			}
+			release, err := r.admission.admit(clientAddr)
+			if err != nil {
+				mu.Unlock()
+				metrics.error(rejectionKind(err))
+				logger.Warn("Rejected UDP session", "client", key, "error", err)
+				continue
+			}
+			target, err := targets.pick()
+			var targetAddr *net.UDPAddr
+			if err == nil {
+				targetAddr, err = target.resolver.resolve()
+			}
+			if err != nil {
+				mu.Unlock()
+				release()
+				metrics.error("resolve")
+				logger.Error("Failed to resolve UDP address", "client", key, "error", err)
+				continue
+			}
+			upstream, err := net.DialUDP("udp", nil, targetAddr)
+			if err != nil {
+				mu.Unlock()
+				release()
+				target.resolver.invalidate()
+				metrics.error("dial")
+				logger.Error("Failed to dial UDP", "client", key, "error", err)
+				continue
+			}
+			tuneConn(upstream)
+			session = &udpSession{
+				clientAddr: clientAddr,
+				upstream:   upstream,
+				resolver:   target.resolver,
+				logger:     withSession(logger),
+			}
+			var untrack func()
+			session.metrics, untrack = r.sessions.track(metrics, key, targetAddr.String())
+			session.touch()
+			sessions[key] = session
+			metrics.sessions.Inc()
+			session.logger.Info("Established UDP session", "client", key, "target", targetAddr.String())
+
+			go func() {
+				handleNativeUDPSession(conn, session, r.udpIdleTimeout)
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+				untrack()
+				metrics.sessions.Dec()
+				session.upstream.Close()
+				release()
+				session.logger.Info("Closed UDP session")
+			}()
+		}
+		mu.Unlock()
+
+		session.touch()
+		session.logger.Debug("Client -> UDP", "bytes", n, payloadAttr((*buf)[:n]))
+		if _, err := session.upstream.Write((*buf)[:n]); err != nil {
+			session.resolver.invalidate()
+			metrics.error("write")
+			session.logger.Error("Error writing to UDP", "error", err)
+			continue
+		}
+		session.metrics.relayedToTarget(n)
+	}
+}
+
+// handleNativeUDPSession relays upstream replies back to the session's client
+// until the session has been idle for idleTimeout or its upstream socket is
+// closed because the tunnel stopped.
+func handleNativeUDPSession(conn *net.UDPConn, session *udpSession, idleTimeout time.Duration) {
+	metrics := session.metrics
+	defer recoverPanic(session.logger, metrics)
+	buf := datagramBuffers.get()
+	defer datagramBuffers.put(buf)
+	for {
+		session.setIdleDeadline(session.upstream, idleTimeout)
+		n, err := session.upstream.Read((*buf)[:bufferSettings.maxDatagram])
+		if err != nil {
+			if isTimeout(err) {
+				if session.idle() < idleTimeout {
+					continue
+				}
+				metrics.ended("idle")
+				session.logger.Info("Closing idle UDP session", "idle_timeout", idleTimeout.String())
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				metrics.ended("shutdown")
+				return
+			}
+			session.resolver.invalidate()
+			metrics.error("read")
+			session.logger.Error("Error reading from UDP", "error", err)
+			return
+		}
+		session.touch()
+		session.logger.Debug("UDP -> Client", "bytes", n, payloadAttr((*buf)[:n]))
+
+		if _, err := conn.WriteToUDP((*buf)[:n], session.clientAddr); err != nil {
+			metrics.error("write")
+			session.logger.Error("Error writing to client", "error", err)
+			return
+		}
+		metrics.relayedToClient(n)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startWebSocketProxy accepts WebSocket connections on any path and relays
+// their binary messages as a byte stream to the TCP target, so tunnels can
+// pass through ingress controllers and proxies that only speak HTTP(S).
+func (r *relay) startWebSocketProxy(tunnel tunnelConfig) error {
+	logger := slog.With("tunnel", tunnel.Name)
+	listener, err := r.listenStream(tunnel.LocalPort)
+	if err != nil {
+		return fmt.Errorf("failed to start WebSocket listener: %w", err)
+	}
+	defer listener.Close()
+	r.closeOnShutdown(listener)
+	r.ready.markReady(tunnel.Name)
+
+	targets := r.targetsFor(tunnel, logger)
+	logger.Info("WebSocket proxy listening", "port", tunnel.LocalPort, "target", tunnel.targetDescription())
+
+	metrics := newTunnelMetrics(tunnel.Name)
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  tcpBufferSize,
+		WriteBufferSize: tcpBufferSize,
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientAddr := remoteAddr(req.RemoteAddr)
+		release, err := r.admission.admit(clientAddr)
+		if err != nil {
+			metrics.error(rejectionKind(err))
+			logger.Warn("Rejected connection", "client", req.RemoteAddr, "error", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		defer release()
+
+		ws, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			metrics.error("upgrade")
+			logger.Warn("WebSocket upgrade failed", "client", req.RemoteAddr, "error", err)
+			return
+		}
+
+		r.sessions.start()
+		defer r.sessions.done()
+		logger := withSession(logger)
+		logger.Info("Accepted WebSocket connection", "client", req.RemoteAddr)
+		r.relayTCP(&wsConn{Conn: ws}, targets, logger, metrics)
+	})
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelDebug),
+	}
+	if err := server.Serve(listener); err != nil && !r.shuttingDown(err) {
+		fatal("WebSocket server failed", "tunnel", tunnel.Name, "error", err)
+	}
+	return nil
+}
+
+// remoteAddr parses an http.Request RemoteAddr into a net.Addr for the
+// admission checks.
+func remoteAddr(addr string) net.Addr {
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		return tcpAddr
+	}
+	return &net.TCPAddr{}
+}
+
+// wsConn adapts a WebSocket connection to net.Conn: reads return the
+// contents of consecutive binary messages and each write is sent as one
+// binary message.
+type wsConn struct {
+	*websocket.Conn
+	reader io.Reader
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.NextReader()
+			if err != nil {
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) && closeErr.Code == websocket.CloseNormalClosure {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite sends a normal closure, which the peer reads as EOF, and keeps
+// reading until the peer closes its side too.
+func (c *wsConn) CloseWrite() error {
+	var deadline time.Time
+	if timeoutSettings.write > 0 {
+		deadline = time.Now().Add(timeoutSettings.write)
+	}
+	return c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
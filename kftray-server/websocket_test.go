@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestWebSocketRelay relays binary messages through a ws tunnel and checks
+// that text messages are dropped and clients outside ALLOWED_CIDRS are
+// refused the upgrade.
+func TestWebSocketRelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowed    string
+		messages   []int // the types of the messages sent, in order
+		want       string
+		wantStatus int // the status of a refused upgrade
+	}{
+		{
+			name:     "binary messages",
+			messages: []int{websocket.BinaryMessage, websocket.BinaryMessage},
+			want:     "ping 0 ping 1 ",
+		},
+		{
+			name:     "text message skipped",
+			messages: []int{websocket.TextMessage, websocket.BinaryMessage},
+			want:     "ping 1 ",
+		},
+		{
+			name:       "client outside ALLOWED_CIDRS",
+			allowed:    "192.0.2.0/24",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ALLOWED_CIDRS", tt.allowed)
+			addr := startEchoTunnel(t, newTestRelay(t), "ws")
+
+			ws, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/", nil)
+			if tt.wantStatus != 0 {
+				if err == nil {
+					ws.Close()
+					t.Fatal("upgrade succeeded, want it refused")
+				}
+				if resp == nil || resp.StatusCode != tt.wantStatus {
+					t.Fatalf("upgrade error = %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+			ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+			for i, messageType := range tt.messages {
+				message := []byte("ping " + strconv.Itoa(i) + " ")
+				if err := ws.WriteMessage(messageType, message); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := make([]byte, len(tt.want))
+			if _, err := io.ReadFull(&wsConn{Conn: ws}, got); err != nil {
+				t.Fatalf("read relayed data: %v", err)
+			}
+			if !bytes.Equal(got, []byte(tt.want)) {
+				t.Errorf("echoed %q, want %q", got, tt.want)
+			}
+		})
+	}
+}